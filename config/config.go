@@ -1,11 +1,102 @@
 package config
 
+import (
+	"net/http"
+	"time"
+)
+
 var (
 	Version string
 
-	Username string
-	Password string
-	Address string
-	LMTPServer string
-	Tag string
+	Username              string
+	Password              string
+	Address               string
+	Folders               []string
+	FolderID              string
+	Limit                 int
+	Order                 string
+	IDs                   []string
+	Delivery              string
+	LMTPServer            string
+	LMTPHostname          string
+	LMTPMaxPerConn        int
+	EnvelopeFrom          string
+	EnvelopeFromHeader    bool
+	IMAPServer            string
+	IMAPUsername          string
+	IMAPPassword          string
+	FilesDir              string
+	NameTemplate          string
+	NoSync                bool
+	RawFolderNames        bool
+	DateSource            string
+	PreserveConversations bool
+	Include               []string
+	Exclude               []string
+	DeliverRetries        int
+	DeliverRetryDelay     time.Duration
+	SkipErrors            bool
+	CheckpointEvery       int
+	TagInBackground       bool
+	Tag                   string
+	TagScope              string
+	AuditTag              string
+	FailTag               string
+	VerifyTags            bool
+	OnlyUnread            bool
+	EmptyTrash            bool
+	ManifestOut           string
+	SkipDelivered         bool
+	Export                string
+	ExportFormat          string
+	ExportOutput          string
+	Diff                  string
+
+	DumpLoginPages string
+	PrintRequests  bool
+	DryRun         bool
+
+	MaxLoginSteps   int
+	ApprovalTimeout time.Duration
+
+	MaxConns            int
+	MaxIdleConns        int
+	IdleConnTimeout     time.Duration
+	Timeout             time.Duration
+	CertWarnDays        int
+	Headers             http.Header
+	AllowedHosts        []string
+	FromArchive         string
+	OTelEndpoint        string
+	ArchiveFormat       string
+	ArchiveRetries      int
+	Types               string
+	FetchTimeout        time.Duration
+	StallTimeout        time.Duration
+	MaxRuntime          time.Duration
+	Spool               bool
+	SpoolDir            string
+	SaveArchive         string
+	SaveArchiveCompress int
+	NoSpaceCheck        bool
+	AfterCmd            string
+	AfterCmdAlways      bool
+	Webhook             string
+	WebhookSecret       string
+	PingURL             string
+	ThrottleRetries     int
+	ThrottleDelay       time.Duration
+	Retries             int
+	RetryDelay          time.Duration
+	TagBatchSize        int
+
+	Lock     string
+	LockWait bool
+
+	AdminURL      string
+	AdminUser     string
+	AdminPassword string
+	TargetUser    string
+
+	AuthCookieFile string
 )
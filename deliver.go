@@ -0,0 +1,614 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap/utf7"
+	"go.opentelemetry.io/otel/attribute"
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// message is an e-mail read from the archive.
+type message struct {
+	// Path of the e-mail in the archive
+	Name string
+	// Folder of the e-mail, decoded from its path
+	Folder string
+	// Zimbra id of the e-mail, from its path
+	Id string
+	// Reception date of the e-mail, from the source chosen with -date-source
+	Date time.Time
+	// Zimbra flags of the e-mail, from its metadata
+	Flags string
+	// Zimbra id of the conversation of the e-mail, from its metadata
+	Conversation string
+	Header       mail.Header
+	// Whole e-mail, including its header
+	Body *bytes.Reader
+}
+
+// errSkipped is wrapped by the errors of deliverers which couldn't deliver an
+// e-mail, but may still deliver the next ones.
+var errSkipped = errors.New("skipped")
+
+// errArchive is wrapped by the errors reading the archive, which may be worked
+// around by fetching it again.
+var errArchive = errors.New("unreadable archive")
+
+// errTruncated is wrapped along with errArchive by the errors of archives which
+// end too early, like when the download was cut.
+var errTruncated = errors.New("truncated archive")
+
+// tarballError wraps err, which happened reading the tarball.
+func tarballError(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w, %w: %w", errArchive, errTruncated, err)
+	}
+	return fmt.Errorf("%w, invalid tarball: %w", errArchive, err)
+}
+
+// trailerReader tracks whether the tarball read so far ends with the two zero
+// blocks of the end-of-archive marker, since archive/tar reports the end of a
+// stream cut between two entries as the end of the archive.
+type trailerReader struct {
+	r io.Reader
+	// Number of zero bytes ending what was read
+	zeros int
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	i := n - 1
+	for i >= 0 && p[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		t.zeros += n
+	} else {
+		t.zeros = n - 1 - i
+	}
+	return n, err
+}
+
+// complete returns whether the end-of-archive marker was read.
+func (t *trailerReader) complete() bool {
+	return t.zeros >= 2*512
+}
+
+// deliverer stores e-mails read from the archive.  deliver only returns nil
+// once the e-mail is stored for good: the LMTP server accepted the whole of it,
+// the IMAP server appended it, or its file is written and synced, since only
+// then is it tagged as delivered.  It stops waiting to retry once ctx is done.
+type deliverer interface {
+	deliver(ctx context.Context, m *message) error
+	io.Closer
+}
+
+// dryRunDeliverer only logs the e-mails, with -dry-run.
+type dryRunDeliverer struct{}
+
+func (dryRunDeliverer) deliver(ctx context.Context, m *message) error {
+	subject := m.Header.Get("Subject")
+	if decoded, err := wordDecoder.DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	slog.Info("Would deliver",
+		slog.String("id", m.Id),
+		slog.String("folder", m.Folder),
+		slog.String("from", m.Header.Get("From")),
+		slog.String("subject", subject))
+	return nil
+}
+
+func (dryRunDeliverer) Close() error {
+	return nil
+}
+
+// deliveryReport counts what happened to the e-mails of the archive.
+type deliveryReport struct {
+	// Zimbra ids of the delivered e-mails, each added once the deliverer
+	// reported its success, along with those known from the manifest
+	Ids []string
+	// Zimbra ids of the skipped and failed e-mails
+	FailedIds []string
+
+	Seen      int
+	Delivered int
+	Skipped   int
+	Failed    int
+	// E-mails delivered by a previous run according to the manifest, with
+	// -skip-delivered, which are tagged again but not delivered
+	Known int
+	// E-mails of the folders not selected with -include and -exclude
+	Ignored int
+	// Whether there was nothing to deliver because of the filters, rather than
+	// because everything was already delivered
+	NoMatch bool
+
+	// Whether the end of the archive was unreadable, with -skip-errors
+	Truncated bool
+	// Number of ids already passed to the checkpoint, with -checkpoint-every
+	Checkpointed int
+	// Whether the delivery was stopped before the end of the archive
+	Stopped bool
+}
+
+// addFailed records the id of m, which wasn't delivered.
+func (r *deliveryReport) addFailed(m *message) {
+	if m.Id != "" {
+		r.FailedIds = append(r.FailedIds, m.Id)
+	}
+}
+
+// truncate stops the delivery at an unreadable part of the archive.  It returns
+// err, or nil with -skip-errors, so that the e-mails delivered before are
+// still tagged.
+func (r *deliveryReport) truncate(err error) error {
+	if !config.SkipErrors {
+		return err
+	}
+	slog.Warn("Ignoring the rest of the archive", slog.Any("error", err))
+	r.Truncated = true
+	return nil
+}
+
+// check logs the breakdown of the report, and warns if some e-mails are
+// unaccounted for.
+func (r *deliveryReport) check() {
+	attrs := []any{
+		slog.Int("seen", r.Seen),
+		slog.Int("delivered", r.Delivered),
+		slog.Int("skipped", r.Skipped),
+		slog.Int("failed", r.Failed),
+	}
+	if r.Known > 0 {
+		attrs = append(attrs, slog.Int("known", r.Known))
+	}
+	if config.DryRun {
+		slog.Info(fmt.Sprintf("Would store %v e-mails", r.Delivered), attrs...)
+	} else {
+		slog.Info(fmt.Sprintf("Stored %v e-mails", r.Delivered), attrs...)
+	}
+
+	if r.Seen != r.Delivered+r.Skipped+r.Failed+r.Known {
+		slog.Warn("Some e-mails were neither delivered, skipped nor failed", attrs...)
+	}
+	if len(r.Ids) != r.Delivered+r.Known {
+		slog.Warn(fmt.Sprintf("%v delivered e-mails have no id", r.Delivered+r.Known-len(r.Ids)))
+	}
+}
+
+// deliverMails delivers every e-mail of the archive, and reports what happened
+// to them, even on error.  The archive is closed, and may be nil if there is
+// nothing to deliver.  Every e-mail is recorded in the manifest, which may be
+// nil.  With -checkpoint-every, checkpoint is called with the ids of each batch
+// of delivered e-mails, and the manifest is synced.  Once ctx is done, the
+// remaining e-mails aren't delivered.
+func deliverMails(ctx context.Context, d deliverer, archive io.ReadCloser, man *manifest, checkpoint func(ids []string) error) (*deliveryReport, error) {
+	report := &deliveryReport{}
+	defer report.check()
+
+	_, span := tracer.Start(ctx, "deliverMails")
+	archiveReader := &countingReader{r: archive}
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("mails.seen", report.Seen),
+			attribute.Int("mails.delivered", report.Delivered),
+			attribute.Int("mails.skipped", report.Skipped),
+			attribute.Int("mails.failed", report.Failed),
+			attribute.Int64("archive.bytes", archiveReader.n))
+		span.End()
+	}()
+
+	if archive == nil {
+		if filters := activeFilters(); len(filters) > 0 {
+			slog.Info("No new e-mail matches the filters", slog.Any("filters", filters))
+			report.NoMatch = true
+		} else {
+			slog.Info("Nothing new")
+		}
+		return report, nil
+	}
+	defer archive.Close()
+	// Nothing more is read once delivery stops before the end of the archive
+	complete := false
+	defer func() {
+		if a, ok := archive.(abandoner); ok && !complete {
+			a.abandon()
+		}
+	}()
+
+	var zr io.Reader = archiveReader
+	if config.ArchiveFormat == "tgz" {
+		var err error
+		zr, err = gzip.NewReader(archiveReader)
+		if err != nil {
+			return report, fmt.Errorf("%w, invalid gzip stream: %w", errArchive, err)
+		}
+	}
+
+	trailer := &trailerReader{r: zr}
+	zr = trailer
+
+	// Metadata of the e-mails, by name, preceding them
+	metas := make(map[string]itemMeta)
+
+	tr := tar.NewReader(zr)
+	next := func() (*tar.Header, io.Reader, error) {
+		hdr, err := tr.Next()
+		return hdr, tr, err
+	}
+	if config.Order == "thread" {
+		threads, err := readThreads(zr)
+		if threads == nil {
+			return report, err
+		}
+		defer threads.Close()
+		// The rest of the archive was already read, up to its end
+		complete = err == nil
+		if err != nil {
+			if err = report.truncate(err); err != nil {
+				return report, err
+			}
+		}
+		next = threads.next
+	}
+
+	slog.Info("Reading archive")
+	for {
+		if ctx.Err() != nil {
+			slog.Warn("Stopping before delivering every e-mail", slog.Any("error", context.Cause(ctx)))
+			report.Stopped = true
+			break
+		}
+
+		hdr, r, err := next()
+		if err == io.EOF && !trailer.complete() && !report.Truncated {
+			err = fmt.Errorf("%w, %w: no end-of-archive marker", errArchive, errTruncated)
+			return report, report.truncate(err)
+		}
+		if err == io.EOF {
+			complete = true
+			break
+		}
+		if err != nil && ctx.Err() != nil {
+			// The download was aborted along with the delivery
+			slog.Warn("Stopping before delivering every e-mail", slog.Any("error", context.Cause(ctx)))
+			report.Stopped = true
+			break
+		}
+		if err != nil {
+			return report, report.truncate(tarballError(err))
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			slog.Warn("Ignoring irregular file",
+				slog.String("name", hdr.Name),
+				slog.Int("type", int(hdr.Typeflag)))
+			continue
+		}
+
+		if path.Ext(hdr.Name) == ".meta" {
+			var meta itemMeta
+			err = json.NewDecoder(r).Decode(&meta)
+			if err != nil {
+				slog.Debug("Ignoring unreadable metadata",
+					slog.String("name", hdr.Name),
+					slog.Any("error", err))
+				continue
+			}
+			metas[strings.TrimSuffix(hdr.Name, ".meta")] = meta
+			continue
+		}
+
+		if path.Ext(hdr.Name) == ".eml" {
+			if folder := folderPath(hdr.Name); !folderSelected(folder) {
+				slog.Debug("Ignoring e-mail of unselected folder",
+					slog.String("name", hdr.Name),
+					slog.String("folder", folder))
+				report.Ignored++
+				continue
+			}
+
+			report.Seen++
+
+			m, err := readMessage(hdr, r)
+			if err != nil && ctx.Err() != nil {
+				slog.Warn("Stopping before delivering every e-mail", slog.Any("error", context.Cause(ctx)))
+				// It wasn't read whole
+				report.Seen--
+				report.Stopped = true
+				break
+			}
+			if err != nil {
+				report.Failed++
+				return report, report.truncate(err)
+			}
+			meta := metas[hdr.Name]
+			m.Flags = meta.Flags
+			m.Conversation = meta.conversation()
+			if config.PreserveConversations && m.Conversation != "" {
+				m.addHeader("X-Zimbra-Conversation-Id", m.Conversation)
+			}
+
+			if man.delivered(m.Id) {
+				// Tagged again, in case tagging failed after its delivery
+				slog.Debug("Skipping e-mail already delivered", slog.String("name", hdr.Name))
+				report.Known++
+				report.Ids = append(report.Ids, m.Id)
+				continue
+			}
+
+			slog.Debug("Delivering e-mail", slog.String("name", hdr.Name))
+			err = d.deliver(ctx, m)
+			if errors.Is(err, errSkipped) {
+				slog.Warn("Skipping e-mail", slog.String("name", hdr.Name), slog.Any("error", err))
+				man.record(m, err)
+				report.Skipped++
+				report.addFailed(m)
+				continue
+			}
+			if err != nil {
+				man.record(m, err)
+				report.Failed++
+				report.addFailed(m)
+				return report, err
+			}
+			man.record(m, nil)
+			report.Delivered++
+
+			if m.Id == "" {
+				slog.Error("Cannot find id in file name", slog.String("name", hdr.Name))
+				continue
+			}
+			report.Ids = append(report.Ids, m.Id)
+
+			if config.CheckpointEvery > 0 && len(report.Ids)-report.Checkpointed >= config.CheckpointEvery {
+				slog.Info("Checkpoint", slog.Int("delivered", report.Delivered))
+				man.sync()
+				err = checkpoint(report.Ids[report.Checkpointed:])
+				if err != nil {
+					return report, fmt.Errorf("checkpoint failed: %w", err)
+				}
+				report.Checkpointed = len(report.Ids)
+			}
+		}
+	}
+
+	if report.Seen == 0 && report.Ignored > 0 {
+		slog.Info("No e-mail of the archive matches the filters",
+			slog.Any("filters", activeFilters()),
+			slog.Int("ignored", report.Ignored))
+		report.NoMatch = true
+	}
+
+	return report, nil
+}
+
+// activeFilters returns the options narrowing down the e-mails to deliver,
+// besides those delivered already.
+func activeFilters() []string {
+	var filters []string
+	if config.OnlyUnread {
+		filters = append(filters, "-only-unread")
+	}
+	if len(config.Include) > 0 {
+		filters = append(filters, "-include")
+	}
+	if len(config.Exclude) > 0 {
+		filters = append(filters, "-exclude")
+	}
+	return filters
+}
+
+// itemMeta is the metadata of an e-mail, in the .meta entry preceding it in the
+// archive.
+type itemMeta struct {
+	Flags string `json:"flags"`
+	// Id of the conversation, negative for an e-mail alone in its
+	// conversation, as a number or a string
+	ParentId json.RawMessage `json:"parent_id"`
+}
+
+// conversation returns the id of the conversation of the e-mail, or "" if it
+// is unknown.
+func (meta itemMeta) conversation() string {
+	id := strings.Trim(string(meta.ParentId), `"`)
+	if id == "null" {
+		return ""
+	}
+	return id
+}
+
+// addHeader prepends the header field name: value to m, with the same line
+// ending as its first line.
+func (m *message) addHeader(name, value string) {
+	data := make([]byte, m.Body.Size())
+	m.Body.ReadAt(data, 0)
+
+	eol := "\n"
+	if i := bytes.IndexByte(data, '\n'); i > 0 && data[i-1] == '\r' {
+		eol = "\r\n"
+	}
+	field := name + ": " + value + eol
+
+	m.Body = bytes.NewReader(append([]byte(field), data...))
+	m.Header[textproto.CanonicalMIMEHeaderKey(name)] = []string{value}
+}
+
+// readMessage reads the e-mail of the current entry of the archive.
+func readMessage(hdr *tar.Header, r io.Reader) (*message, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, tarballError(err)
+	}
+
+	m := &message{
+		Name:   hdr.Name,
+		Folder: folderPath(hdr.Name),
+		Body:   bytes.NewReader(data),
+	}
+
+	// Zimbra names e-mails after their id, like 0000257-Subject.eml
+	id, _, found := strings.Cut(path.Base(hdr.Name), "-")
+	if found {
+		m.Id = strings.TrimLeft(id, "0")
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		slog.Debug("Cannot parse e-mail header",
+			slog.String("name", hdr.Name),
+			slog.Any("error", err))
+		m.Header = mail.Header{}
+	} else {
+		m.Header = msg.Header
+	}
+	m.Date = messageDate(hdr.ModTime, m.Header)
+
+	return m, nil
+}
+
+// dateSources are the sources of the reception dates of e-mails, each falling
+// back to the next one when it is missing or invalid.
+var dateSources = []string{"received", "date", "tarmtime"}
+
+// messageDate returns the reception date of the e-mail with header, which was
+// modified at mtime in the archive, from config.DateSource or the sources
+// after it.
+func messageDate(mtime time.Time, header mail.Header) time.Time {
+	i := slices.Index(dateSources, config.DateSource)
+	for _, source := range dateSources[i:] {
+		switch source {
+		case "received":
+			// The topmost one was added by the last server, Zimbra's
+			if received := header["Received"]; len(received) > 0 {
+				if date, ok := receivedDate(received[0]); ok {
+					return date
+				}
+			}
+		case "date":
+			if date, err := header.Date(); err == nil {
+				return date
+			}
+		}
+	}
+	return mtime
+}
+
+// receivedDate parses the date of a Received header field, which comes after
+// its last semicolon, possibly followed by comments like "(CET)".
+func receivedDate(received string) (time.Time, bool) {
+	i := strings.LastIndexByte(received, ';')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	value := strings.Join(strings.Fields(received[i+1:]), " ")
+
+	for value != "" {
+		if date, err := mail.ParseDate(value); err == nil {
+			return date, true
+		}
+		// Without a trailing comment mail.ParseDate doesn't understand
+		open := strings.LastIndexByte(value, '(')
+		if open < 0 || !strings.HasSuffix(value, ")") {
+			break
+		}
+		value = strings.TrimSpace(value[:open])
+	}
+	return time.Time{}, false
+}
+
+// folderPath returns the folder of the archive entry name, with each of its
+// components decoded from IMAP modified UTF-7 or RFC 2047 encoded-words when
+// they are encoded that way, unless config.RawFolderNames is set.
+func folderPath(name string) string {
+	folder := path.Dir(stripArchivePrefix(name))
+	if config.RawFolderNames {
+		return folder
+	}
+
+	parts := strings.Split(folder, "/")
+	for i, part := range parts {
+		parts[i] = decodeFolderName(part)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// stripArchivePrefix strips the prefix of the archive entry name which isn't
+// part of its folder, like the "./" of archives made with tar, or the
+// "home/ADDRESS/" of some full mailbox exports.
+func stripArchivePrefix(name string) string {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "./"), "/")
+
+	if rest, found := strings.CutPrefix(name, "home/"); found {
+		account, rest, found := strings.Cut(rest, "/")
+		if found && strings.Contains(account, "@") {
+			name = rest
+		}
+	}
+
+	return name
+}
+
+// folderSelected reports whether the e-mails of folder should be delivered,
+// according to the -include and -exclude globs.  Excludes take precedence, and
+// every folder is included when there is no -include glob.
+func folderSelected(folder string) bool {
+	for _, glob := range config.Exclude {
+		if matched, _ := path.Match(glob, folder); matched {
+			return false
+		}
+	}
+
+	if len(config.Include) == 0 {
+		return true
+	}
+	for _, glob := range config.Include {
+		if matched, _ := path.Match(glob, folder); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+var wordDecoder = mime.WordDecoder{}
+
+func decodeFolderName(name string) string {
+	if !utf8.ValidString(name) {
+		return name
+	}
+
+	if strings.Contains(name, "=?") {
+		if decoded, err := wordDecoder.DecodeHeader(name); err == nil {
+			return decoded
+		}
+	}
+
+	if strings.Contains(name, "&") {
+		// This fails on names which aren't valid modified UTF-7
+		if decoded, err := utf7.Encoding.NewDecoder().String(name); err == nil {
+			return decoded
+		}
+	}
+
+	return name
+}
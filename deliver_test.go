@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// recordingDeliverer records the e-mails it is given.
+type recordingDeliverer struct {
+	mails []*message
+}
+
+func (d *recordingDeliverer) deliver(ctx context.Context, m *message) error {
+	d.mails = append(d.mails, m)
+	return nil
+}
+
+func (d *recordingDeliverer) Close() error {
+	return nil
+}
+
+// makeTar returns a tarball with an e-mail at each of names.
+func makeTar(t testing.TB, names ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		body := []byte("From: a@example.com\r\nSubject: " + name + "\r\n\r\nHello\r\n")
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(body)),
+			ModTime:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// setTestConfig sets the configuration deliverMails depends on for the
+// duration of the test.
+func setTestConfig(t testing.TB) {
+	t.Helper()
+
+	saved := struct {
+		format, source, order string
+		raw                   bool
+	}{config.ArchiveFormat, config.DateSource, config.Order, config.RawFolderNames}
+	t.Cleanup(func() {
+		config.ArchiveFormat = saved.format
+		config.DateSource = saved.source
+		config.Order = saved.order
+		config.RawFolderNames = saved.raw
+	})
+
+	config.ArchiveFormat = "tar"
+	config.DateSource = "received"
+	config.Order = "date"
+	config.RawFolderNames = false
+}
+
+func TestDeliverMailsArchiveLayouts(t *testing.T) {
+	setTestConfig(t)
+
+	tests := []struct {
+		name    string
+		entries []string
+		folders []string
+	}{
+		{
+			name: "REST export",
+			entries: []string{
+				"Inbox/0000257-Hello.eml",
+				"Projects/Archive/0000258-Report.eml",
+			},
+			folders: []string{"Inbox", "Projects/Archive"},
+		},
+		{
+			name: "zmmailbox export",
+			entries: []string{
+				"./home/user@etu.cyu.fr/Inbox/0000257-Hello.eml",
+				"./home/user@etu.cyu.fr/Projects/Archive/0000258-Report.eml",
+			},
+			folders: []string{"Inbox", "Projects/Archive"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archive := io.NopCloser(bytes.NewReader(makeTar(t, test.entries...)))
+			d := &recordingDeliverer{}
+			report, err := deliverMails(context.Background(), d, archive, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var folders []string
+			for _, m := range d.mails {
+				folders = append(folders, m.Folder)
+			}
+			if !slices.Equal(folders, test.folders) {
+				t.Errorf("folders = %q, want %q", folders, test.folders)
+			}
+			if want := []string{"257", "258"}; !slices.Equal(report.Ids, want) {
+				t.Errorf("ids = %q, want %q", report.Ids, want)
+			}
+		})
+	}
+}
+
+func TestDecodeFolderName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Inbox", "Inbox"},
+		// Modified UTF-7
+		{"&BBIERQQ+BDQETwRJBDgENQ-", "Входящие"},
+		{"Re&AOc-us", "Reçus"},
+		{"&AMk-l&AOk-ments envoy&AOk-s", "Éléments envoyés"},
+		{"Tom &- Jerry", "Tom & Jerry"},
+		// RFC 2047
+		{"=?utf-8?b?0JLRhdC+0LTRj9GJ0LjQtQ==?=", "Входящие"},
+		{"=?iso-8859-1?q?Re=E7us?=", "Reçus"},
+		// Raw UTF-8, left as is
+		{"Входящие", "Входящие"},
+		{"Reçus", "Reçus"},
+		{"Tom & Jerry", "Tom & Jerry"},
+		{"Re\xe7us", "Re\xe7us"},
+	}
+	for _, test := range tests {
+		if got := decodeFolderName(test.name); got != test.want {
+			t.Errorf("decodeFolderName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFolderPath(t *testing.T) {
+	setTestConfig(t)
+
+	tests := []struct {
+		name  string
+		raw   bool
+		entry string
+		want  string
+	}{
+		{name: "flat", entry: "Inbox/0000257-Hello.eml", want: "Inbox"},
+		{name: "modified UTF-7", entry: "&BBIERQQ+BDQETwRJBDgENQ-/Re&AOc-us/0000257-Hello.eml", want: "Входящие/Reçus"},
+		{name: "RFC 2047", entry: "=?utf-8?b?UmXDp3Vz?=/0000257-Hello.eml", want: "Reçus"},
+		{name: "raw UTF-8", entry: "Входящие/Reçus/0000257-Hello.eml", want: "Входящие/Reçus"},
+		{name: "prefixed", entry: "./home/user@etu.cyu.fr/Re&AOc-us/0000257-Hello.eml", want: "Reçus"},
+		{name: "raw folder names", raw: true, entry: "Re&AOc-us/0000257-Hello.eml", want: "Re&AOc-us"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.RawFolderNames = test.raw
+			if got := folderPath(test.entry); got != test.want {
+				t.Errorf("folderPath(%q) = %q, want %q", test.entry, got, test.want)
+			}
+		})
+	}
+}
+
+// discardDeliverer drops the e-mails it is given.
+type discardDeliverer struct{}
+
+func (discardDeliverer) deliver(ctx context.Context, m *message) error {
+	return nil
+}
+
+func (discardDeliverer) Close() error {
+	return nil
+}
+
+// benchmarkArchive returns a tarball of 500 e-mails of about 20 KB each.
+func benchmarkArchive(b *testing.B) []byte {
+	b.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	// Random words, so that it doesn't compress much better than e-mails
+	words := strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor incididunt ut labore et dolore magna aliqua")
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range 500 {
+		body := []byte("From: a@example.com\r\nSubject: Hello\r\n\r\n")
+		for len(body) < 20_000 {
+			for range 10 {
+				body = append(body, words[rng.IntN(len(words))]...)
+				body = append(body, ' ')
+			}
+			body = append(body, "\r\n"...)
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Name:     "Inbox/" + strconv.Itoa(1000+i) + "-Hello.eml",
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(body)),
+			ModTime:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// benchmarkDeliver measures delivering archive, in format, of size bytes once
+// uncompressed.
+func benchmarkDeliver(b *testing.B, format string, archive []byte, size int) {
+	setTestConfig(b)
+	config.ArchiveFormat = format
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for range b.N {
+		_, err := deliverMails(context.Background(), discardDeliverer{}, io.NopCloser(bytes.NewReader(archive)), nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDeliverTgz(b *testing.B) {
+	archive := benchmarkArchive(b)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(archive); err != nil {
+		b.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkDeliver(b, "tgz", buf.Bytes(), len(archive))
+}
+
+func BenchmarkDeliverTar(b *testing.B) {
+	archive := benchmarkArchive(b)
+	benchmarkDeliver(b, "tar", archive, len(archive))
+}
+
+func TestMain(m *testing.M) {
+	// The benchmarks would mostly measure logging otherwise
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
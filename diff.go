@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"ransan.fr/zimbridge/mda/config"
+	"ransan.fr/zimbridge/mda/zimbra"
+)
+
+// diff prints the ids of the e-mails of the folder which aren't delivered
+// according to the manifest, as missing, and of the delivered e-mails which
+// aren't in the folder anymore, as deleted.
+func diff(ctx context.Context, client *http.Client) error {
+	delivered, err := readManifestIds(config.Diff)
+	if err != nil {
+		return fmt.Errorf("cannot read manifest: %w", err)
+	}
+
+	ids, err := zimbra.FolderIDs(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	onServer := make(map[string]bool, len(ids))
+	var missing, deleted int
+	for _, id := range ids {
+		onServer[id] = true
+		if !delivered[id] {
+			fmt.Printf("missing\t%s\n", id)
+			missing++
+		}
+	}
+	for id := range delivered {
+		if !onServer[id] {
+			fmt.Printf("deleted\t%s\n", id)
+			deleted++
+		}
+	}
+	slog.Info("Compared with manifest",
+		slog.Int("server", len(ids)),
+		slog.Int("delivered", len(delivered)),
+		slog.Int("missing", missing),
+		slog.Int("deleted", deleted))
+
+	return nil
+}
+
+// readManifestIds returns the set of ids of the e-mails delivered according to
+// the manifest at path.
+func readManifestIds(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var entry manifestEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%v: %w", path, line, err)
+		}
+		if entry.Status == "delivered" && entry.Id != "" {
+			ids[entry.Id] = true
+		}
+	}
+
+	return ids, scanner.Err()
+}
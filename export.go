@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"ransan.fr/zimbridge/mda/config"
+	"ransan.fr/zimbridge/mda/zimbra"
+)
+
+// exportFormats are the formats each folder can be exported in, the first one
+// being the default.
+var exportFormats = map[string][]string{
+	"calendar": {"ics"},
+	"contacts": {"vcf", "csv"},
+}
+
+// export writes the folder config.Export of the mailbox to config.ExportOutput.
+func export(ctx context.Context, client *http.Client) error {
+	body, err := zimbra.FetchExport(ctx, client, config.Export, config.ExportFormat)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(config.ExportOutput)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, body)
+	closeErr := f.Close()
+	if err != nil {
+		return fmt.Errorf("cannot write export: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("cannot write export: %w", closeErr)
+	}
+	slog.Info(fmt.Sprintf("Exported %v bytes", n), slog.String("file", config.ExportOutput))
+
+	return nil
+}
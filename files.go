@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// maxSubjectLength is the maximum length in bytes of a subject in a file name.
+const maxSubjectLength = 80
+
+// maxNameLength is the maximum length in bytes of a file name on most file
+// systems.
+const maxNameLength = 255
+
+// filesDeliverer writes e-mails to .eml files in a directory, in
+// subdirectories mirroring the folders of the archive, named after
+// config.NameTemplate.
+type filesDeliverer struct {
+	dir string
+}
+
+func newFilesDeliverer() (*filesDeliverer, error) {
+	err := os.MkdirAll(config.FilesDir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create directory: %w", err)
+	}
+
+	return &filesDeliverer{dir: config.FilesDir}, nil
+}
+
+func (d *filesDeliverer) deliver(ctx context.Context, m *message) error {
+	parts := strings.Split(m.Folder, "/")
+	for i, part := range parts {
+		parts[i] = sanitizeName(part)
+	}
+	dir := filepath.Join(append([]string{d.dir}, parts...)...)
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+
+	name := fileName(m)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, fs.ErrExist) {
+			name = base + "-" + strconv.Itoa(i) + ext
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(f, m.Body)
+		if err == nil && !config.NoSync {
+			err = f.Sync()
+		}
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return fmt.Errorf("cannot write %s: %w", f.Name(), err)
+		}
+
+		// So that file managers sort e-mails by date
+		if m.Date.IsZero() {
+			slog.Debug("No reception date, keeping the time of delivery", slog.String("file", f.Name()))
+		} else if err := os.Chtimes(f.Name(), m.Date, m.Date); err != nil {
+			slog.Debug("Cannot set modification time",
+				slog.String("file", f.Name()),
+				slog.Any("error", err))
+		}
+
+		// Otherwise, the e-mail could be tagged as delivered, but its file
+		// missing after a crash
+		if !config.NoSync {
+			err = syncDir(dir)
+			if err != nil {
+				return fmt.Errorf("cannot sync %s: %w", dir, err)
+			}
+		}
+		return nil
+	}
+}
+
+// syncDir flushes the entries of the directory dir to the disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (d *filesDeliverer) Close() error {
+	return nil
+}
+
+// fileName returns the name of the file of m, expanding config.NameTemplate
+// with its reception date and sanitized headers.
+func fileName(m *message) string {
+	subject := m.Header.Get("Subject")
+	if decoded, err := wordDecoder.DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	subject = truncate(sanitizeName(subject), maxSubjectLength)
+	if subject == "" {
+		subject = "no subject"
+	}
+
+	var from string
+	if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+		from = sanitizeName(addr.Address)
+	}
+
+	t := m.Date.Local()
+	name := strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+		"%M", t.Format("04"),
+		"%S", t.Format("05"),
+		"%{subject}", subject,
+		"%{from}", from,
+		"%{id}", sanitizeName(m.Id),
+		"%%", "%",
+	).Replace(config.NameTemplate)
+
+	// Keeping the extension, so that the suffix of collisions can fit too
+	ext := filepath.Ext(name)
+	return truncate(strings.TrimSuffix(name, ext), maxNameLength-len(ext)-8) + ext
+}
+
+// sanitizeName makes s usable as a file name: the characters which aren't
+// allowed in file names on some file system, like "/" or ":", and control
+// characters, become "_", runs of white space become a single space, and
+// leading and trailing spaces and dots are trimmed, so that it isn't hidden or
+// a parent directory.
+func sanitizeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case strings.ContainsRune(`/\:*?"<>|`, r), unicode.IsControl(r), r == utf8.RuneError:
+			return '_'
+		default:
+			return r
+		}
+	}, s)
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.Trim(s, " .")
+}
+
+// truncate returns the longest prefix of s of at most n bytes which doesn't
+// split a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return strings.TrimRight(s[:n], " .")
+}
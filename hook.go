@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// runAfterCmd runs config.AfterCmd with the shell, if at least one e-mail was
+// delivered or config.AfterCmdAlways is set.  The number of delivered e-mails
+// is passed in $ZIMBRIDGE_MDA_DELIVERED.
+func runAfterCmd(report *deliveryReport) error {
+	if config.AfterCmd == "" || (report.Delivered == 0 && !config.AfterCmdAlways) {
+		return nil
+	}
+
+	slog.Info("Running after command", slog.String("command", config.AfterCmd))
+	cmd := exec.Command("/bin/sh", "-c", config.AfterCmd)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("ZIMBRIDGE_MDA_DELIVERED=%v", report.Delivered))
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		slog.Info("After command output", slog.String("output", strings.TrimSpace(string(output))))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", config.AfterCmd, err)
+	}
+	slog.Debug("Ran after command", slog.Int("status", cmd.ProcessState.ExitCode()))
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// imapDeliverer appends e-mails to the mailboxes of an IMAP account, mirroring
+// the folders of the archive.
+type imapDeliverer struct {
+	client    *client.Client
+	delimiter string
+	mailboxes map[string]bool
+}
+
+func newIMAPDeliverer() (*imapDeliverer, error) {
+	c, err := client.DialTLS(config.IMAPServer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", config.IMAPServer, err)
+	}
+
+	err = c.Login(config.IMAPUsername, config.IMAPPassword)
+	if err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("IMAP LOGIN: %w", err)
+	}
+
+	// An empty mailbox name only requests the hierarchy delimiter
+	infos, err := listMailboxes(c, "")
+	if err != nil {
+		c.Logout()
+		return nil, err
+	}
+	delimiter := "/"
+	if len(infos) > 0 && infos[0].Delimiter != "" {
+		delimiter = infos[0].Delimiter
+	}
+
+	return &imapDeliverer{
+		client:    c,
+		delimiter: delimiter,
+		mailboxes: make(map[string]bool),
+	}, nil
+}
+
+func listMailboxes(c *client.Client, name string) ([]*imap.MailboxInfo, error) {
+	ch := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", name, ch)
+	}()
+
+	var infos []*imap.MailboxInfo
+	for info := range ch {
+		infos = append(infos, info)
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("IMAP LIST: %w", err)
+	}
+
+	return infos, nil
+}
+
+// mailbox returns the name of the IMAP mailbox corresponding to a folder of
+// the archive, creating it if needed.
+func (d *imapDeliverer) mailbox(folder string) (string, error) {
+	name := mailboxName(folder, d.delimiter)
+	if d.mailboxes[name] {
+		return name, nil
+	}
+
+	infos, err := listMailboxes(d.client, name)
+	if err != nil {
+		return "", err
+	}
+	if len(infos) == 0 {
+		slog.Info("Creating IMAP mailbox", slog.String("mailbox", name))
+		err = d.client.Create(name)
+		if err != nil {
+			return "", fmt.Errorf("IMAP CREATE %s: %w", name, err)
+		}
+	}
+	d.mailboxes[name] = true
+
+	return name, nil
+}
+
+// mailboxName returns the name of the IMAP mailbox corresponding to a folder of
+// the archive, on a server whose hierarchy delimiter is delimiter.  E-mails at
+// the root of the archive go to the inbox.
+func mailboxName(folder, delimiter string) string {
+	if folder == "." || folder == "" {
+		return "INBOX"
+	}
+
+	parts := strings.Split(folder, "/")
+	if strings.EqualFold(parts[0], "inbox") {
+		parts[0] = "INBOX"
+	}
+	for i, part := range parts {
+		parts[i] = escapeMailboxPart(part, delimiter)
+	}
+	return strings.Join(parts, delimiter)
+}
+
+// mailboxEscape starts the escape sequences of mailbox names.
+const mailboxEscape = '~'
+
+// escapeMailboxPart escapes the delimiter in part, a component of a folder
+// name, as the hexadecimal value of its bytes after mailboxEscape, like
+// Dovecot's escape character does, and mailboxEscape itself, so that distinct
+// folders never share a mailbox.  Otherwise, a folder named "Projects.2024"
+// would become a "2024" mailbox in "Projects" with Maildir++ servers, whose
+// delimiter is ".".
+func escapeMailboxPart(part, delimiter string) string {
+	var b strings.Builder
+	for len(part) > 0 {
+		n := 1
+		if delimiter != "" && strings.HasPrefix(part, delimiter) {
+			n = len(delimiter)
+		} else if part[0] != mailboxEscape {
+			b.WriteByte(part[0])
+			part = part[1:]
+			continue
+		}
+		for _, c := range []byte(part[:n]) {
+			fmt.Fprintf(&b, "%c%02X", mailboxEscape, c)
+		}
+		part = part[n:]
+	}
+	return b.String()
+}
+
+func (d *imapDeliverer) deliver(ctx context.Context, m *message) error {
+	mbox, err := d.mailbox(m.Folder)
+	if err != nil {
+		return err
+	}
+
+	err = d.client.Append(mbox, imapFlags(m.Flags), m.Date, m.Body)
+	if err != nil {
+		return fmt.Errorf("IMAP APPEND %s: %w", mbox, err)
+	}
+
+	return nil
+}
+
+func (d *imapDeliverer) Close() error {
+	return d.client.Logout()
+}
+
+// imapFlags converts Zimbra flags to IMAP flags.
+func imapFlags(flags string) []string {
+	var imapFlags []string
+	if !strings.ContainsRune(flags, 'u') {
+		imapFlags = append(imapFlags, imap.SeenFlag)
+	}
+
+	for _, f := range flags {
+		switch f {
+		case 'f':
+			imapFlags = append(imapFlags, imap.FlaggedFlag)
+		case 'r':
+			imapFlags = append(imapFlags, imap.AnsweredFlag)
+		case 'd':
+			imapFlags = append(imapFlags, imap.DraftFlag)
+		case 'w':
+			imapFlags = append(imapFlags, "$Forwarded")
+		}
+	}
+
+	return imapFlags
+}
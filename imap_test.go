@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestMailboxName(t *testing.T) {
+	tests := []struct {
+		folder, delimiter, want string
+	}{
+		{".", ".", "INBOX"},
+		{".", "/", "INBOX"},
+		{"Inbox", ".", "INBOX"},
+		{"inbox/Projects", "/", "INBOX/Projects"},
+		{"Projects.2024", ".", "Projects~2E2024"},
+		{"Projects.2024", "/", "Projects.2024"},
+		{"Projects_2024", ".", "Projects_2024"},
+		{"Projects~2E2024", ".", "Projects~7E2E2024"},
+		{"A/B", ".", "A.B"},
+		{"A/B", "/", "A/B"},
+		{"Projects.2024/A.B", ".", "Projects~2E2024.A~2EB"},
+	}
+	for _, test := range tests {
+		if got := mailboxName(test.folder, test.delimiter); got != test.want {
+			t.Errorf("mailboxName(%q, %q) = %q, want %q", test.folder, test.delimiter, got, test.want)
+		}
+	}
+}
+
+func TestMailboxNameDistinct(t *testing.T) {
+	// Folders which a lossy escape would merge
+	folders := []string{
+		"Projects.2024", "Projects_2024", "Projects~2E2024", "Projects~2024",
+		"Projects/2024", "A.B/C", "A/B.C", "A/B/C",
+	}
+	for _, delimiter := range []string{".", "/"} {
+		seen := map[string]string{}
+		for _, folder := range folders {
+			name := mailboxName(folder, delimiter)
+			if other, ok := seen[name]; ok {
+				t.Errorf("%q and %q both map to %q with delimiter %q", other, folder, name, delimiter)
+			}
+			seen[name] = folder
+		}
+	}
+}
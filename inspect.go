@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"text/tabwriter"
+)
+
+// inspect prints the folder, id, size, sender, subject and date of each
+// e-mail of the archive saved at name, gzipped or not.
+func inspect(name string) error {
+	archive, format, err := openArchive(name)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	var r io.Reader = archive
+	if format == "tgz" {
+		r, err = gzip.NewReader(archive)
+		if err != nil {
+			return fmt.Errorf("invalid gzip stream: %w", err)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FOLDER\tID\tSIZE\tFROM\tSUBJECT\tDATE")
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.Flush()
+			return fmt.Errorf("invalid tarball: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Ext(hdr.Name) != ".eml" {
+			continue
+		}
+
+		m, err := readMessage(hdr, tr)
+		if err != nil {
+			w.Flush()
+			return err
+		}
+		subject, err := wordDecoder.DecodeHeader(m.Header.Get("Subject"))
+		if err != nil {
+			subject = m.Header.Get("Subject")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\n",
+			m.Folder, m.Id, m.Body.Size(), m.Header.Get("From"), subject, m.Header.Get("Date"))
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"ransan.fr/zimbridge/mda/config"
+	"ransan.fr/zimbridge/mda/zimbra"
+)
+
+// selectMails returns the ids of the e-mails to fetch with -limit, skipping
+// those delivered according to the manifest.
+func selectMails(ctx context.Context, client *http.Client) ([]string, error) {
+	var delivered map[string]bool
+	if config.ManifestOut != "" {
+		var err error
+		delivered, err = readManifestIds(config.ManifestOut)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("cannot read manifest: %w", err)
+		}
+	}
+
+	ids, err := zimbra.SelectIDs(ctx, client, func(id string) bool { return delivered[id] })
+	if err != nil {
+		return nil, err
+	}
+	slog.Info(fmt.Sprintf("Selected %v e-mails", len(ids)), slog.String("order", config.Order))
+
+	return ids, nil
+}
+
+// missingIds warns about the e-mails of -ids which weren't in the archive.
+func missingIds(report *deliveryReport) {
+	var missing []string
+	for _, id := range config.IDs {
+		if !slices.Contains(report.Ids, id) && !slices.Contains(report.FailedIds, id) {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		slog.Warn(fmt.Sprintf("Zimbra didn't return %v e-mails", len(missing)), slog.Any("ids", missing))
+	}
+}
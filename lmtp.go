@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// lmtpDeliverer delivers e-mails to an LMTP server, listening on a UNIX socket.
+type lmtpDeliverer struct {
+	conn   net.Conn
+	client *smtp.Client
+	// Number of transactions done over conn
+	sent int
+	// Whether conn can't be used for the next transaction
+	broken bool
+}
+
+func newLMTPDeliverer() (*lmtpDeliverer, error) {
+	d := &lmtpDeliverer{}
+	err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// dial connects to the LMTP server.
+func (d *lmtpDeliverer) dial() error {
+	conn, err := net.Dial("unix", config.LMTPServer)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", config.LMTPServer, err)
+	}
+
+	client := smtp.NewClientLMTP(conn)
+	err = client.Hello(config.LMTPHostname)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("LMTP LHLO: %w", err)
+	}
+
+	d.conn = conn
+	d.client = client
+	d.sent = 0
+	d.broken = false
+	return nil
+}
+
+// redial closes the connection to the LMTP server, and connects again.
+func (d *lmtpDeliverer) redial() error {
+	d.Close()
+	return d.dial()
+}
+
+// dropped reports whether err means that the LMTP server closed the
+// connection.
+func dropped(err error) bool {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		// Service not available, closing transmission channel
+		return smtpErr.Code == 421
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+var hostnameRegexp = regexp.MustCompile(`^[[:alnum:]]([[:alnum:]-]{0,61}[[:alnum:]])?(\.[[:alnum:]]([[:alnum:]-]{0,61}[[:alnum:]])?)*$`)
+
+// validHostname reports whether name can be announced in LHLO.
+func validHostname(name string) bool {
+	return len(name) <= 253 && hostnameRegexp.MatchString(name)
+}
+
+// validAddress reports whether address is a bare e-mail address, which can be
+// given in MAIL FROM.
+func validAddress(address string) bool {
+	addr, err := mail.ParseAddress(address)
+	return err == nil && addr.Name == "" && addr.Address == address
+}
+
+// envelopeFrom returns the envelope sender of m: config.EnvelopeFrom, or with
+// -envelope-from-header the address of its Return-Path header, or else of its
+// From header, or else the null sender.
+func envelopeFrom(m *message) string {
+	if !config.EnvelopeFromHeader {
+		return config.EnvelopeFrom
+	}
+
+	for _, name := range []string{"Return-Path", "From"} {
+		value := strings.TrimSpace(m.Header.Get(name))
+		if value == "<>" {
+			// Bounces are sent with the null sender
+			return ""
+		}
+		addr, err := mail.ParseAddress(value)
+		if err == nil && usableSender(addr.Address) {
+			return addr.Address
+		}
+	}
+
+	slog.Debug("No usable sender address, giving the null sender", slog.String("name", m.Name))
+	return ""
+}
+
+// usableSender reports whether address can be given in MAIL FROM to servers
+// which don't support SMTPUTF8.
+func usableSender(address string) bool {
+	for _, r := range address {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return strings.Contains(address, "@")
+}
+
+// systemHostname returns the hostname of the system, or localhost if it
+// can't be announced in LHLO.
+func systemHostname() string {
+	name, err := os.Hostname()
+	if err != nil || !validHostname(name) {
+		return "localhost"
+	}
+	return name
+}
+
+func (d *lmtpDeliverer) deliver(ctx context.Context, m *message) error {
+	delay := config.DeliverRetryDelay
+	redialed := false
+	for attempt := 0; ; attempt++ {
+		if d.broken || config.LMTPMaxPerConn > 0 && d.sent >= config.LMTPMaxPerConn {
+			slog.Debug("Reconnecting to LMTP server", slog.Int("sent", d.sent))
+			err := d.redial()
+			if err != nil {
+				return err
+			}
+		}
+
+		err := d.send(m)
+
+		if dropped(err) {
+			slog.Warn("LMTP server closed the connection, reconnecting",
+				slog.String("name", m.Name),
+				slog.Any("error", err))
+			rerr := d.redial()
+			if rerr != nil {
+				return rerr
+			}
+
+			// The e-mail is sent again right away, once
+			if !redialed {
+				redialed = true
+				_, err = m.Body.Seek(0, io.SeekStart)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) {
+			return err
+		}
+		if !smtpErr.Temporary() {
+			return fmt.Errorf("%w, rejected by LMTP server: %w", errSkipped, err)
+		}
+		if attempt >= config.DeliverRetries {
+			return err
+		}
+
+		slog.Warn("Temporary LMTP failure, retrying later",
+			slog.String("name", m.Name),
+			slog.Any("error", err),
+			slog.Duration("delay", delay))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+		delay *= 2
+
+		_, err = m.Body.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// send does one LMTP transaction delivering m.  It returns a *smtp.SMTPError
+// if the server refused m.  Once the server answered the data, m isn't sent
+// again whatever happens next, since it may have been delivered.
+func (d *lmtpDeliverer) send(m *message) error {
+	d.sent++
+	err := d.client.Mail(envelopeFrom(m), nil)
+	if err != nil {
+		d.client.Reset()
+		return fmt.Errorf("LMTP MAIL: %w", err)
+	}
+
+	err = d.client.Rcpt(config.Address, nil)
+	if err != nil {
+		d.client.Reset()
+		return fmt.Errorf("LMTP RCPT: %w", err)
+	}
+
+	var rcptErr *smtp.SMTPError
+	data, err := d.client.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		if status != nil {
+			slog.Warn("LMTP error", slog.String("rcpt", rcpt), slog.Any("status", *status))
+			rcptErr = status
+		}
+	})
+	if err != nil {
+		d.client.Reset()
+		return fmt.Errorf("LMTP DATA: %w", err)
+	}
+
+	_, err = io.Copy(data, m.Body)
+	closeErr := data.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return fmt.Errorf("close data: %w", closeErr)
+	}
+
+	err = d.client.Reset()
+	if err != nil {
+		// E.g. the server closes the connection after a number of e-mails
+		slog.Warn("LMTP RSET failed, reconnecting before the next e-mail",
+			slog.String("name", m.Name),
+			slog.Any("error", err))
+		d.broken = true
+	}
+
+	if rcptErr != nil {
+		return fmt.Errorf("LMTP DATA: %w", rcptErr)
+	}
+
+	return nil
+}
+
+func (d *lmtpDeliverer) Close() error {
+	d.client.Quit()
+	return d.conn.Close()
+}
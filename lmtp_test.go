@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// droppingLMTPServer accepts one e-mail per connection, and closes the
+// connection right after acknowledging its data.
+type droppingLMTPServer struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (s *droppingLMTPServer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *droppingLMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("220 localhost LMTP ready\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch verb, _, _ := strings.Cut(strings.TrimSpace(line), " "); strings.ToUpper(verb) {
+		case "LHLO":
+			conn.Write([]byte("250 localhost\r\n"))
+		case "MAIL", "RCPT":
+			conn.Write([]byte("250 OK\r\n"))
+		case "DATA":
+			conn.Write([]byte("354 Go ahead\r\n"))
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mu.Unlock()
+			conn.Write([]byte("250 Delivered\r\n"))
+			return
+		default:
+			conn.Write([]byte("500 Unknown command\r\n"))
+		}
+	}
+}
+
+func TestLMTPDeliverDroppedAfterData(t *testing.T) {
+	server, hostname, address := config.LMTPServer, config.LMTPHostname, config.Address
+	from, fromHeader, perConn := config.EnvelopeFrom, config.EnvelopeFromHeader, config.LMTPMaxPerConn
+	t.Cleanup(func() {
+		config.LMTPServer, config.LMTPHostname, config.Address = server, hostname, address
+		config.EnvelopeFrom, config.EnvelopeFromHeader, config.LMTPMaxPerConn = from, fromHeader, perConn
+	})
+	config.LMTPServer = filepath.Join(t.TempDir(), "lmtp")
+	config.LMTPHostname, config.Address = "localhost", "user@etu.cyu.fr"
+	config.EnvelopeFrom, config.EnvelopeFromHeader, config.LMTPMaxPerConn = "", false, 0
+
+	l, err := net.Listen("unix", config.LMTPServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &droppingLMTPServer{}
+	go s.serve(l)
+
+	d, err := newLMTPDeliverer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, subject := range []string{"First", "Second"} {
+		m := &message{
+			Name: "Inbox/" + subject + ".eml",
+			Body: bytes.NewReader([]byte("Subject: " + subject + "\r\n\r\nHello\r\n")),
+		}
+		if err := d.deliver(context.Background(), m); err != nil {
+			t.Fatalf("deliver %s: %v", subject, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) != 2 {
+		t.Fatalf("server got %v e-mails, want 2: %q", len(s.messages), s.messages)
+	}
+	for i, subject := range []string{"First", "Second"} {
+		if !strings.HasPrefix(s.messages[i], "Subject: "+subject+"\r\n") {
+			t.Errorf("e-mail %v = %q, want %s", i, s.messages[i], subject)
+		}
+	}
+}
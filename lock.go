@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var errAlreadyRunning = errors.New("another instance is already running")
+
+// lockFile takes an exclusive lock on the file at path, creating it if needed.
+// If the lock is already held, lockFile waits for it to be released if wait is
+// true, or fails with errAlreadyRunning.  The lock is held as long as the
+// returned file is open.
+func lockFile(path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	err = syscall.Flock(int(f.Fd()), how)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		f.Close()
+		return nil, errAlreadyRunning
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %s: %w", path, err)
+	}
+
+	return f, nil
+}
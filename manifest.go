@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// manifest records the delivered e-mails in a file, as one JSON object per
+// line.
+type manifest struct {
+	f   *os.File
+	enc *json.Encoder
+	// Ids of the e-mails delivered by the previous runs, with -skip-delivered
+	previous map[string]bool
+}
+
+type manifestEntry struct {
+	Id        string `json:"id"`
+	Folder    string `json:"folder"`
+	MessageId string `json:"message_id,omitempty"`
+	Date      string `json:"date,omitempty"`
+	Size      int64  `json:"size"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// openManifest opens the manifest at path, appending to it if it exists.
+func openManifest(path string) (*manifest, error) {
+	var previous map[string]bool
+	if config.SkipDelivered {
+		var err error
+		previous, err = readManifestIds(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("cannot read manifest: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifest{f: f, enc: json.NewEncoder(f), previous: previous}, nil
+}
+
+// delivered reports whether the e-mail id was delivered by a previous run,
+// with -skip-delivered.  It returns false on a nil manifest.
+func (man *manifest) delivered(id string) bool {
+	return man != nil && id != "" && man.previous[id]
+}
+
+// record writes an entry for m, delivered unless err is non-nil.  It does
+// nothing on a nil manifest.
+func (man *manifest) record(m *message, err error) {
+	if man == nil {
+		return
+	}
+
+	entry := manifestEntry{
+		Id:        m.Id,
+		Folder:    m.Folder,
+		MessageId: m.Header.Get("Message-Id"),
+		Date:      m.Header.Get("Date"),
+		Size:      m.Body.Size(),
+		Status:    "delivered",
+	}
+	if err != nil {
+		entry.Status = "failed"
+		entry.Error = err.Error()
+	}
+
+	if err := man.enc.Encode(entry); err != nil {
+		slog.Warn("Cannot write to manifest",
+			slog.Any("error", err),
+			slog.String("manifest", man.f.Name()))
+	}
+}
+
+// sync commits the manifest to disk.  It does nothing on a nil manifest.
+func (man *manifest) sync() {
+	if man == nil {
+		return
+	}
+
+	if err := man.f.Sync(); err != nil {
+		slog.Warn("Cannot sync manifest",
+			slog.Any("error", err),
+			slog.String("manifest", man.f.Name()))
+	}
+}
+
+func (man *manifest) Close() error {
+	if man == nil {
+		return nil
+	}
+	return man.f.Close()
+}
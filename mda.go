@@ -1,28 +1,36 @@
 package main
 
 import (
-	"archive/tar"
 	"compress/gzip"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
-	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/emersion/go-smtp"
+	"golang.org/x/net/http/httpguts"
 	"ransan.fr/zimbridge/mda/config"
 	"ransan.fr/zimbridge/mda/zimbra"
 )
 
 func main() {
-	defaultUsername := os.Getenv("ZIMBRIDGE_MDA_USERNAME")
+	defaultUsername := envCredential("ZIMBRIDGE_MDA_USERNAME", "username")
 	flag.StringVar(&config.Username, "u", defaultUsername, "")
 	flag.StringVar(&config.Username, "username", defaultUsername, "")
 
-	defaultPassword := os.Getenv("ZIMBRIDGE_MDA_PASSWORD")
+	defaultPassword := envCredential("ZIMBRIDGE_MDA_PASSWORD", "password")
 	flag.StringVar(&config.Password, "p", defaultPassword, "")
 	flag.StringVar(&config.Password, "password", defaultPassword, "")
 
@@ -34,11 +42,321 @@ func main() {
 	flag.StringVar(&config.Tag, "t", defaultTag, "")
 	flag.StringVar(&config.Tag, "tag", defaultTag, "")
 
+	defaultTagScope := os.Getenv("ZIMBRIDGE_MDA_TAG_SCOPE")
+	flag.StringVar(&config.TagScope, "tag-scope", defaultTagScope, "")
+
+	defaultDelivery := os.Getenv("ZIMBRIDGE_MDA_DELIVERY")
+	if defaultDelivery == "" {
+		defaultDelivery = "lmtp"
+	}
+	flag.StringVar(&config.Delivery, "d", defaultDelivery, "")
+	flag.StringVar(&config.Delivery, "delivery", defaultDelivery, "")
+
+	defaultNameTemplate := os.Getenv("ZIMBRIDGE_MDA_NAME_TEMPLATE")
+	if defaultNameTemplate == "" {
+		defaultNameTemplate = "%Y-%m-%d_%{subject}.eml"
+	}
+	flag.StringVar(&config.NameTemplate, "name-template", defaultNameTemplate, "")
+	flag.BoolVar(&config.NoSync, "no-sync", os.Getenv("ZIMBRIDGE_MDA_NO_SYNC") == "1", "")
+
+	defaultIMAPUsername := os.Getenv("ZIMBRIDGE_MDA_IMAP_USERNAME")
+	flag.StringVar(&config.IMAPUsername, "imap-username", defaultIMAPUsername, "")
+
+	defaultIMAPPassword := envCredential("ZIMBRIDGE_MDA_IMAP_PASSWORD", "imap-password")
+	flag.StringVar(&config.IMAPPassword, "imap-password", defaultIMAPPassword, "")
+
+	defaultRawFolderNames := os.Getenv("ZIMBRIDGE_MDA_RAW_FOLDER_NAMES") == "1"
+	flag.BoolVar(&config.RawFolderNames, "raw-folder-names", defaultRawFolderNames, "")
+
+	flag.Func("include", "", func(glob string) error {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+		config.Include = append(config.Include, glob)
+		return nil
+	})
+	flag.Func("exclude", "", func(glob string) error {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+		config.Exclude = append(config.Exclude, glob)
+		return nil
+	})
+
+	defaultLMTPHostname := os.Getenv("ZIMBRIDGE_MDA_LMTP_HOSTNAME")
+	if defaultLMTPHostname == "" {
+		defaultLMTPHostname = systemHostname()
+	}
+	flag.StringVar(&config.LMTPHostname, "lmtp-hostname", defaultLMTPHostname, "")
+
+	defaultLMTPMaxPerConn := envInt("ZIMBRIDGE_MDA_LMTP_MAX_PER_CONN", 0)
+	flag.IntVar(&config.LMTPMaxPerConn, "lmtp-max-per-conn", defaultLMTPMaxPerConn, "")
+
+	defaultEnvelopeFrom := os.Getenv("ZIMBRIDGE_MDA_ENVELOPE_FROM")
+	flag.StringVar(&config.EnvelopeFrom, "envelope-from", defaultEnvelopeFrom, "")
+
+	defaultEnvelopeFromHeader := os.Getenv("ZIMBRIDGE_MDA_ENVELOPE_FROM_HEADER") == "1"
+	flag.BoolVar(&config.EnvelopeFromHeader, "envelope-from-header", defaultEnvelopeFromHeader, "")
+
+	defaultDateSource := os.Getenv("ZIMBRIDGE_MDA_DATE_SOURCE")
+	if defaultDateSource == "" {
+		defaultDateSource = "received"
+	}
+	flag.StringVar(&config.DateSource, "date-source", defaultDateSource, "")
+
+	defaultPreserveConversations := os.Getenv("ZIMBRIDGE_MDA_PRESERVE_CONVERSATIONS") == "1"
+	flag.BoolVar(&config.PreserveConversations, "preserve-conversations", defaultPreserveConversations, "")
+
+	defaultSkipErrors := os.Getenv("ZIMBRIDGE_MDA_SKIP_ERRORS") == "1"
+	flag.BoolVar(&config.SkipErrors, "skip-errors", defaultSkipErrors, "")
+
+	defaultCheckpointEvery := envInt("ZIMBRIDGE_MDA_CHECKPOINT_EVERY", 0)
+	flag.IntVar(&config.CheckpointEvery, "checkpoint-every", defaultCheckpointEvery, "")
+
+	defaultTagInBackground := os.Getenv("ZIMBRIDGE_MDA_TAG_IN_BACKGROUND") == "1"
+	flag.BoolVar(&config.TagInBackground, "tag-in-background", defaultTagInBackground, "")
+
+	defaultDeliverRetries := envInt("ZIMBRIDGE_MDA_DELIVER_RETRIES", 3)
+	flag.IntVar(&config.DeliverRetries, "deliver-retries", defaultDeliverRetries, "")
+
+	defaultDeliverRetryDelay := envDuration("ZIMBRIDGE_MDA_DELIVER_RETRY_DELAY", 5*time.Second)
+	flag.DurationVar(&config.DeliverRetryDelay, "deliver-retry-delay", defaultDeliverRetryDelay, "")
+
+	defaultFailTag := os.Getenv("ZIMBRIDGE_MDA_FAIL_TAG")
+	flag.StringVar(&config.FailTag, "fail-tag", defaultFailTag, "")
+
+	defaultAuditTag := os.Getenv("ZIMBRIDGE_MDA_AUDIT_TAG")
+	flag.StringVar(&config.AuditTag, "audit-tag", defaultAuditTag, "")
+
+	defaultVerifyTags := os.Getenv("ZIMBRIDGE_MDA_VERIFY_TAGS") == "1"
+	flag.BoolVar(&config.VerifyTags, "verify-tags", defaultVerifyTags, "")
+
+	defaultEmptyTrash := os.Getenv("ZIMBRIDGE_MDA_EMPTY_TRASH") == "1"
+	flag.BoolVar(&config.EmptyTrash, "empty-trash", defaultEmptyTrash, "")
+
+	var yesFlag bool
+	flag.BoolVar(&yesFlag, "y", false, "")
+	flag.BoolVar(&yesFlag, "yes", false, "")
+
+	defaultAuthCookieFile := os.Getenv("ZIMBRIDGE_MDA_AUTH_COOKIE_FILE")
+	flag.StringVar(&config.AuthCookieFile, "auth-cookie-file", defaultAuthCookieFile, "")
+
+	defaultAdminURL := os.Getenv("ZIMBRIDGE_MDA_ADMIN_URL")
+	if defaultAdminURL == "" {
+		defaultAdminURL = "https://mail.etu.cyu.fr:7071/service/admin/soap"
+	}
+	flag.StringVar(&config.AdminURL, "admin-url", defaultAdminURL, "")
+
+	defaultAdminUser := os.Getenv("ZIMBRIDGE_MDA_ADMIN_USER")
+	flag.StringVar(&config.AdminUser, "admin-user", defaultAdminUser, "")
+
+	defaultAdminPassword := envCredential("ZIMBRIDGE_MDA_ADMIN_PASS", "admin-pass")
+	flag.StringVar(&config.AdminPassword, "admin-pass", defaultAdminPassword, "")
+
+	defaultTargetUser := os.Getenv("ZIMBRIDGE_MDA_TARGET_USER")
+	flag.StringVar(&config.TargetUser, "target-user", defaultTargetUser, "")
+
+	defaultOnlyUnread := os.Getenv("ZIMBRIDGE_MDA_ONLY_UNREAD") == "1"
+	flag.BoolVar(&config.OnlyUnread, "only-unread", defaultOnlyUnread, "")
+
+	defaultMaxLoginSteps := envInt("ZIMBRIDGE_MDA_MAX_LOGIN_STEPS", 10)
+	flag.IntVar(&config.MaxLoginSteps, "max-login-steps", defaultMaxLoginSteps, "")
+
+	defaultApprovalTimeout := envDuration("ZIMBRIDGE_MDA_APPROVAL_TIMEOUT", 2*time.Minute)
+	flag.DurationVar(&config.ApprovalTimeout, "approval-timeout", defaultApprovalTimeout, "")
+
+	defaultCertWarnDays := envInt("ZIMBRIDGE_MDA_CERT_WARN_DAYS", 14)
+	flag.IntVar(&config.CertWarnDays, "cert-warn-days", defaultCertWarnDays, "")
+
+	defaultMaxConns := envInt("ZIMBRIDGE_MDA_MAX_CONNS", 4)
+	flag.IntVar(&config.MaxConns, "max-conns", defaultMaxConns, "")
+
+	defaultMaxIdleConns := envInt("ZIMBRIDGE_MDA_MAX_IDLE_CONNS", 4)
+	flag.IntVar(&config.MaxIdleConns, "max-idle-conns", defaultMaxIdleConns, "")
+
+	defaultIdleConnTimeout := envDuration("ZIMBRIDGE_MDA_IDLE_CONN_TIMEOUT", 90*time.Second)
+	flag.DurationVar(&config.IdleConnTimeout, "idle-conn-timeout", defaultIdleConnTimeout, "")
+
+	defaultTimeout := envDuration("ZIMBRIDGE_MDA_TIMEOUT", 5*time.Minute)
+	flag.DurationVar(&config.Timeout, "timeout", defaultTimeout, "")
+
+	config.Headers = http.Header{}
+	flag.Func("header", "", func(header string) error {
+		name, value, found := strings.Cut(header, ":")
+		value = strings.TrimSpace(value)
+		if !found || !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid header %q, expected 'Name: Value'", header)
+		}
+		config.Headers.Add(name, value)
+		return nil
+	})
+
+	flag.Func("allow-host", "", func(host string) error {
+		config.AllowedHosts = append(config.AllowedHosts, host)
+		return nil
+	})
+
+	defaultOTelEndpoint := os.Getenv("ZIMBRIDGE_MDA_OTEL_ENDPOINT")
+	flag.StringVar(&config.OTelEndpoint, "otel-endpoint", defaultOTelEndpoint, "")
+
+	defaultFromArchive := os.Getenv("ZIMBRIDGE_MDA_FROM_ARCHIVE")
+	flag.StringVar(&config.FromArchive, "from-archive", defaultFromArchive, "")
+
+	defaultArchiveFormat := os.Getenv("ZIMBRIDGE_MDA_ARCHIVE_FORMAT")
+	if defaultArchiveFormat == "" {
+		defaultArchiveFormat = "tgz"
+	}
+	flag.StringVar(&config.ArchiveFormat, "archive-format", defaultArchiveFormat, "")
+
+	defaultFolder := os.Getenv("ZIMBRIDGE_MDA_FOLDER")
+	if defaultFolder == "" {
+		defaultFolder = "inbox"
+	}
+	flag.Func("folder", "", func(folder string) error {
+		config.Folders = append(config.Folders, folder)
+		return nil
+	})
+
+	defaultFolderID := os.Getenv("ZIMBRIDGE_MDA_FOLDER_ID")
+	flag.StringVar(&config.FolderID, "folder-id", defaultFolderID, "")
+
+	flag.Func("ids", "", func(ids string) error {
+		for _, id := range strings.Split(ids, ",") {
+			if id == "" || strings.Trim(id, "0123456789") != "" {
+				return fmt.Errorf("invalid id %q, expected a number", id)
+			}
+			config.IDs = append(config.IDs, id)
+		}
+		return nil
+	})
+
+	defaultLimit := envInt("ZIMBRIDGE_MDA_LIMIT", 0)
+	flag.IntVar(&config.Limit, "limit", defaultLimit, "")
+
+	defaultOrder := os.Getenv("ZIMBRIDGE_MDA_ORDER")
+	if defaultOrder == "" {
+		defaultOrder = "date"
+	}
+	flag.StringVar(&config.Order, "order", defaultOrder, "")
+
+	defaultTypes := os.Getenv("ZIMBRIDGE_MDA_TYPES")
+	if defaultTypes == "" {
+		defaultTypes = "message"
+	}
+	flag.StringVar(&config.Types, "types", defaultTypes, "")
+
+	defaultMaxRuntime := envDuration("ZIMBRIDGE_MDA_MAX_RUNTIME", 0)
+	flag.DurationVar(&config.MaxRuntime, "max-runtime", defaultMaxRuntime, "")
+
+	defaultArchiveRetries := envInt("ZIMBRIDGE_MDA_ARCHIVE_RETRIES", 0)
+	flag.IntVar(&config.ArchiveRetries, "archive-retries", defaultArchiveRetries, "")
+
+	defaultFetchTimeout := envDuration("ZIMBRIDGE_MDA_FETCH_TIMEOUT", time.Hour)
+	flag.DurationVar(&config.FetchTimeout, "fetch-timeout", defaultFetchTimeout, "")
+
+	defaultStallTimeout := envDuration("ZIMBRIDGE_MDA_STALL_TIMEOUT", 2*time.Minute)
+	flag.DurationVar(&config.StallTimeout, "stall-timeout", defaultStallTimeout, "")
+
+	defaultThrottleRetries := envInt("ZIMBRIDGE_MDA_THROTTLE_RETRIES", 3)
+	flag.IntVar(&config.ThrottleRetries, "throttle-retries", defaultThrottleRetries, "")
+
+	defaultThrottleDelay := envDuration("ZIMBRIDGE_MDA_THROTTLE_DELAY", 30*time.Second)
+	flag.DurationVar(&config.ThrottleDelay, "throttle-delay", defaultThrottleDelay, "")
+
+	defaultRetries := envInt("ZIMBRIDGE_MDA_RETRIES", 3)
+	flag.IntVar(&config.Retries, "retries", defaultRetries, "")
+
+	defaultRetryDelay := envDuration("ZIMBRIDGE_MDA_RETRY_DELAY", time.Second)
+	flag.DurationVar(&config.RetryDelay, "retry-delay", defaultRetryDelay, "")
+
+	defaultTagBatchSize := envInt("ZIMBRIDGE_MDA_TAG_BATCH_SIZE", 100)
+	flag.IntVar(&config.TagBatchSize, "tag-batch-size", defaultTagBatchSize, "")
+
+	defaultExport := os.Getenv("ZIMBRIDGE_MDA_EXPORT")
+	flag.StringVar(&config.Export, "export", defaultExport, "")
+
+	defaultExportFormat := os.Getenv("ZIMBRIDGE_MDA_EXPORT_FORMAT")
+	flag.StringVar(&config.ExportFormat, "export-format", defaultExportFormat, "")
+
+	defaultWebhook := os.Getenv("ZIMBRIDGE_MDA_WEBHOOK")
+	flag.StringVar(&config.Webhook, "webhook", defaultWebhook, "")
+
+	defaultWebhookSecret := envCredential("ZIMBRIDGE_MDA_WEBHOOK_SECRET", "webhook-secret")
+	flag.StringVar(&config.WebhookSecret, "webhook-secret", defaultWebhookSecret, "")
+
+	defaultPingURL := os.Getenv("ZIMBRIDGE_MDA_PING_URL")
+	flag.StringVar(&config.PingURL, "ping-url", defaultPingURL, "")
+
+	defaultAfterCmd := os.Getenv("ZIMBRIDGE_MDA_AFTER_CMD")
+	flag.StringVar(&config.AfterCmd, "after-cmd", defaultAfterCmd, "")
+
+	defaultAfterCmdAlways := os.Getenv("ZIMBRIDGE_MDA_AFTER_CMD_ALWAYS") == "1"
+	flag.BoolVar(&config.AfterCmdAlways, "after-cmd-always", defaultAfterCmdAlways, "")
+
+	defaultSpool := os.Getenv("ZIMBRIDGE_MDA_SPOOL") == "1"
+	flag.BoolVar(&config.Spool, "spool", defaultSpool, "")
+
+	defaultSpoolDir := os.Getenv("ZIMBRIDGE_MDA_SPOOL_DIR")
+	flag.StringVar(&config.SpoolDir, "spool-dir", defaultSpoolDir, "")
+
+	defaultSaveArchive := os.Getenv("ZIMBRIDGE_MDA_SAVE_ARCHIVE")
+	flag.StringVar(&config.SaveArchive, "save-archive", defaultSaveArchive, "")
+
+	defaultSaveArchiveCompress := envInt("ZIMBRIDGE_MDA_SAVE_ARCHIVE_COMPRESS", 0)
+	flag.IntVar(&config.SaveArchiveCompress, "save-archive-compress", defaultSaveArchiveCompress, "")
+
+	defaultNoSpaceCheck := os.Getenv("ZIMBRIDGE_MDA_NO_SPACE_CHECK") == "1"
+	flag.BoolVar(&config.NoSpaceCheck, "no-space-check", defaultNoSpaceCheck, "")
+
+	defaultDiff := os.Getenv("ZIMBRIDGE_MDA_DIFF")
+	flag.StringVar(&config.Diff, "diff", defaultDiff, "")
+
+	defaultManifestOut := os.Getenv("ZIMBRIDGE_MDA_MANIFEST_OUT")
+	flag.StringVar(&config.ManifestOut, "manifest-out", defaultManifestOut, "")
+
+	defaultSkipDelivered := os.Getenv("ZIMBRIDGE_MDA_SKIP_DELIVERED") == "1"
+	flag.BoolVar(&config.SkipDelivered, "skip-delivered", defaultSkipDelivered, "")
+
+	defaultLock := os.Getenv("ZIMBRIDGE_MDA_LOCK")
+	flag.StringVar(&config.Lock, "lock", defaultLock, "")
+
+	defaultLockWait := os.Getenv("ZIMBRIDGE_MDA_LOCK_WAIT") == "1"
+	flag.BoolVar(&config.LockWait, "lock-wait", defaultLockWait, "")
+
+	defaultDumpLoginPages := os.Getenv("ZIMBRIDGE_MDA_DUMP_LOGIN_PAGES")
+	flag.StringVar(&config.DumpLoginPages, "dump-login-pages", defaultDumpLoginPages, "")
+
 	defaultVerbose := os.Getenv("ZIMBRIDGE_MDA_VERBOSE") == "1"
 	var verboseFlag bool
 	flag.BoolVar(&verboseFlag, "v", defaultVerbose, "")
 	flag.BoolVar(&verboseFlag, "verbose", defaultVerbose, "")
 
+	var inspectFlag string
+	flag.StringVar(&inspectFlag, "inspect", "", "")
+
+	var listTagsFlag bool
+	flag.BoolVar(&listTagsFlag, "list-tags", false, "")
+
+	var versionFlag bool
+	flag.BoolVar(&versionFlag, "version", false, "")
+
+	var previewFlag int
+	flag.IntVar(&previewFlag, "preview", 0, "")
+
+	defaultPrintRequests := os.Getenv("ZIMBRIDGE_MDA_PRINT_REQUESTS") == "1"
+	flag.BoolVar(&config.PrintRequests, "print-requests", defaultPrintRequests, "")
+
+	defaultDryRun := os.Getenv("ZIMBRIDGE_MDA_DRY_RUN") == "1"
+	flag.BoolVar(&config.DryRun, "n", defaultDryRun, "")
+	flag.BoolVar(&config.DryRun, "dry-run", defaultDryRun, "")
+
+	var showQueryFlag bool
+	flag.BoolVar(&showQueryFlag, "show-query", false, "")
+
+	defaultRedact := os.Getenv("ZIMBRIDGE_MDA_REDACT") == "1"
+	var redactFlag bool
+	flag.BoolVar(&redactFlag, "redact", defaultRedact, "")
+
 	flag.Usage = func() {
 		fmt.Printf(`zimbridge-mda %s
 Lucas Ransan <lucas@ransan.fr>
@@ -46,199 +364,915 @@ Lucas Ransan <lucas@ransan.fr>
 Zimbridge-MDA (Zimbra bridge, Mail Delivery Agent) uses your USERNAME and your
 PASSWORD to connect to https://mail.etu.cyu.fr (Zimbra webmail instance) and
 download all e-mails from the Inbox folder.  It sends them to a provided
-LMTP_SERVER, like Dovecot, using UNIX sockets.  Zimbridge-MDA can also tag all
-the stored e-mails in the webmail, so that it doesn't fetch them again the next
-time.
+LMTP_SERVER, like Dovecot, using UNIX sockets, appends them to an IMAP account,
+or writes them to files.  Zimbridge-MDA can also tag all the stored e-mails in the webmail, so
+that it doesn't fetch them again the next time.
 
 USAGE:
-    %s -username USERNAME -password PASSWORD -address ADDRESS LMTP_SERVER
+    %s -username USERNAME -password PASSWORD [-address ADDRESS] LMTP_SERVER
+    %s -admin-user ADMIN -admin-pass PASSWORD -target-user ADDRESS LMTP_SERVER
+    %s -delivery imap -imap-username USERNAME -imap-password PASSWORD [...] IMAP_SERVER
+    %s -delivery files [-name-template TEMPLATE] [...] DIR
+    %s -export calendar|contacts [-export-format FORMAT] [...] FILE
 
 POSITIONAL ARGUMENTS:
     <LMTP_SERVER>    Path to UNIX socket where your LMTP server is listening
+    <IMAP_SERVER>    Address (host:port) of the IMAP server, connected to over TLS
+    <DIR>            Directory where the e-mails are written, with -delivery files
+    <FILE>           Path where the exported calendar or contacts are written
 
 OPTIONS:
     -u, -username USERNAME    Your CYU username, probably starting with "e-"
     -p, -password PASSWORD    Your CYU password
-    -a, -address ADDRESS      Your @etu.cyu.fr e-mail address
+    -a, -address ADDRESS      Your @etu.cyu.fr e-mail address (default: fetched
+                              from Zimbra once logged in)
     -t, -tag TAG              Tag e-mails in your webmail
+    -tag-scope FOLDER         Only skip the e-mails tagged in FOLDER, one of the
+                              -folder, rather than in every folder
+    -d, -delivery METHOD      How to deliver e-mails: "lmtp" (default), "imap",
+                              which appends them to the IMAP mailboxes mirroring
+                              their Zimbra folders, or "files", which writes
+                              them to .eml files in the directories mirroring
+                              their Zimbra folders
+    -name-template TEMPLATE   Name of the files with -delivery files, where %%Y,
+                              %%m, %%d, %%H, %%M and %%S are replaced by the
+                              reception date and time, and %%{subject},
+                              %%{from} and %%{id} by the subject, the sender and
+                              the Zimbra id of the e-mail
+                              (default: "%%Y-%%m-%%d_%%{subject}.eml")
+    -no-sync                  Don't flush the files to the disk before going on
+                              with the next e-mail, with -delivery files
+    -imap-username USERNAME   Your IMAP username, with -delivery imap
+    -imap-password PASSWORD   Your IMAP password, with -delivery imap
+    -raw-folder-names         Don't decode folder names of the archive encoded in
+                              modified UTF-7 or RFC 2047 encoded-words
+    -include GLOB             Only deliver e-mails of the folders matching GLOB,
+                              e.g. "Projects/*", can be repeated
+    -exclude GLOB             Don't deliver e-mails of the folders matching GLOB,
+                              even if included, can be repeated
+    -lmtp-hostname HOSTNAME   Name announced to the LMTP server (default: the
+                              hostname of the system)
+    -lmtp-max-per-conn N      Reconnect to the LMTP server every N e-mails, 0 to
+                              keep the same connection (default: 0)
+    -envelope-from ADDRESS    Envelope sender given to the LMTP server, instead
+                              of the null sender, the From header being kept
+    -envelope-from-header     Give the address of the Return-Path header, or else
+                              of the From header, of each e-mail as envelope
+                              sender to the LMTP server, instead of the null
+                              sender
+    -date-source SOURCE       Where the reception date of e-mails, the internal
+                              date with -delivery imap and the modification time
+                              with -delivery files, comes from: "received" for
+                              the topmost Received header (default), "date" for
+                              the Date header, or "tarmtime" for the archive,
+                              each falling back to the next ones
+    -preserve-conversations   Add an X-Zimbra-Conversation-Id header to e-mails,
+                              with the id of their Zimbra conversation
+    -skip-errors              If the archive is corrupt, still tag the e-mails
+                              delivered before the corrupt part, instead of
+                              failing
+    -checkpoint-every N       Tag the delivered e-mails every N e-mails, instead
+                              of only once all are delivered, so that an
+                              interrupted run doesn't deliver them again, 0 to
+                              disable (default: 0)
+    -tag-in-background        With -checkpoint-every, tag each batch of e-mails
+                              while the next ones are delivered, and only fail
+                              after delivering them if tagging failed
+    -deliver-retries N        How many times to retry delivering an e-mail after a
+                              temporary LMTP failure (default: 3)
+    -deliver-retry-delay DURATION
+                              How long to wait before retrying, doubled after each
+                              retry (default: 5s)
+    -audit-tag TEMPLATE       Also tag e-mails with this tag, where %%Y, %%m, %%d, %%H,
+                              %%M and %%S are replaced by the date and time of the
+                              run, e.g. "synced-%%Y%%m%%d"
+    -fail-tag TAG             Tag e-mails which couldn't be delivered with this
+                              tag in your webmail, created if needed
+    -verify-tags              Don't tag again e-mails which are already tagged
+    -empty-trash              Permanently delete everything in the Trash folder of
+                              your webmail after delivering, once confirmed
+    -y, -yes                  Don't ask for confirmation of irreversible actions
+    -auth-cookie-file PATH    Don't log in, but reuse the ZM_AUTH_TOKEN cookie of
+                              a browser session, exported to PATH
+    -admin-user ADMIN         Authenticate as this Zimbra administrator instead,
+                              and fetch the e-mails of the target account
+    -admin-pass PASSWORD      The administrator's password
+    -admin-url URL            Zimbra admin SOAP endpoint
+                              (default: https://mail.etu.cyu.fr:7071/service/admin/soap)
+    -target-user ACCOUNT      Account to fetch with -admin-user (default: ADDRESS)
+    -only-unread              Only fetch e-mails that are unread in your webmail
+    -diff MANIFEST            Print the ids of the e-mails of the folder which
+                              aren't delivered according to MANIFEST, written by
+                              -manifest-out, and of those which were deleted from
+                              the folder since, and quit
+    -inspect ARCHIVE          Print the e-mails of ARCHIVE, a tarball saved from
+                              Zimbra, and quit
+    -list-tags                Print the tags of your webmail and quit
+    -preview N                Print the sender, subject and date of the N newest
+                              e-mails which would be fetched, without fetching
+                              them, and quit
+    -print-requests           Print the SOAP requests which would tag e-mails,
+                              create tags or empty the trash in your webmail,
+                              instead of sending them, still delivering e-mails
+    -n, -dry-run              Fetch the e-mails and print those which would be
+                              delivered, without delivering nor tagging them
+    -show-query               Print the URL e-mails would be fetched from and quit
+    -max-login-steps N        Give up logging in after this many forms, 0 for no
+                              limit (default: 10)
+    -approval-timeout DURATION
+                              How long to wait for a second factor to be approved,
+                              e.g. on your phone, 0 to not wait (default: 2m)
+    -cert-warn-days N         Warn if the TLS certificate of Zimbra expires within
+                              N days, 0 to never warn (default: 14)
+    -max-conns N              Maximum number of simultaneous requests to Zimbra,
+                              0 for no limit (default: 4)
+    -max-idle-conns N         Maximum number of idle connections to Zimbra kept
+                              open for later requests (default: 4)
+    -idle-conn-timeout DURATION
+                              How long to keep an idle connection to Zimbra open,
+                              0 for no limit (default: 1m30s)
+    -timeout DURATION         Give up a request to Zimbra if it isn't answered
+                              within this long, 0 for no limit; the download of
+                              the e-mails only has to start answering, and is
+                              limited by -fetch-timeout and -stall-timeout
+                              (default: 5m)
+    -header 'NAME: VALUE'     Add this header to every request to Zimbra, can be
+                              repeated
+    -allow-host HOST          Allow logging in through HOST, besides the webmail
+                              and the CAS, which the login is otherwise stopped
+                              at if redirected to, can be repeated
+    -from-archive ARCHIVE     Deliver the e-mails of ARCHIVE, a tarball saved from
+                              Zimbra or exported with zmmailbox, instead of
+                              fetching them, without logging in unless they are
+                              to be tagged
+    -archive-format FORMAT    Format in which e-mails are downloaded: "tgz"
+                              (default), or "tar", only compressed for transport
+    -folder FOLDER            Zimbra folder to download e-mails from, e.g.
+                              "Projects/Archive", can be repeated (default:
+                              inbox)
+    -folder-id ID             Id of the Zimbra folder to download e-mails from
+                              instead, e.g. 2 for the inbox
+    -ids ID,...               Only fetch these e-mails, wherever they are and even
+                              if they are tagged, e.g. to deliver them again
+    -limit N                  Only fetch the first N e-mails which aren't tagged
+                              yet, or not delivered according to -manifest-out,
+                              0 for no limit (default: 0)
+    -order ORDER              Which e-mails come first with -limit: "date" for
+                              the oldest (default), "date-desc" for the newest,
+                              or "thread" to also deliver them thread by thread,
+                              each e-mail after the one it replies to
+    -types TYPES              Comma-separated types of items to download, among
+                              "message", "conversation", "appointment", "task",
+                              "contact", "document" and "wiki", or "" for all of
+                              them (default: message)
+    -max-runtime DURATION     Stop delivering after this long since the start of
+                              the run, tag the delivered e-mails, and exit with
+                              status 3, 0 for no limit (default: 0)
+    -archive-retries N        How many times to fetch the archive again if it
+                              can't be read, as long as no e-mail was delivered
+                              (default: 0)
+    -fetch-timeout DURATION   Abort downloading the e-mails after this long, 0 to
+                              never abort (default: 1h)
+    -stall-timeout DURATION   Abort downloading the e-mails if no data is received
+                              for this long, 0 to never abort (default: 2m)
+    -throttle-retries N       How many times to retry a request throttled by Zimbra
+                              (default: 3)
+    -throttle-delay DURATION  How long to wait before retrying a throttled request,
+                              doubled after each retry (default: 30s)
+    -retries N                How many times to retry a GET request to Zimbra after
+                              a network error or a 5xx status code, or another
+                              request if it couldn't be sent (default: 3)
+    -retry-delay DURATION     How long to wait before retrying a failed request,
+                              doubled after each retry (default: 1s)
+    -tag-batch-size N         How many e-mails to tag per request (default: 100)
+    -export KIND              Instead of delivering e-mails, export your "calendar"
+                              or your "contacts" to FILE
+    -export-format FORMAT     Format of the export: "ics" for the calendar, "vcf"
+                              (default) or "csv" for the contacts
+    -after-cmd COMMAND        Run this shell command once e-mails were successfully
+                              delivered, e.g. "notmuch new", with their number in
+                              $ZIMBRIDGE_MDA_DELIVERED
+    -after-cmd-always         Run the after command even if no e-mail was delivered
+    -webhook URL              POST a JSON summary of the run to URL once it is
+                              over, whether it succeeded or not
+    -webhook-secret SECRET    Sign the summary with HMAC-SHA256 using SECRET, in
+                              the X-Zimbridge-Signature header
+    -ping-url URL             Request URL/start when starting, and URL or URL/fail
+                              once the run is over, e.g. for healthchecks.io
+    -spool                    Download the whole archive to a temporary file before
+                              delivering, removed once delivered
+    -spool-dir DIR            Directory of the temporary file (default: $TMPDIR)
+    -save-archive PATH        Also save the fetched archive to PATH, once it was
+                              downloaded whole, which it isn't if delivery stops
+                              early, e.g. after -max-runtime or on a signal
+    -save-archive-compress LEVEL
+                              Gzip the saved archive at this level, from 1 (the
+                              fastest) to 9 (the smallest), if it was fetched
+                              uncompressed with -archive-format tar, 0 to save
+                              it as it is (default: 0)
+    -no-space-check           Don't check that there is enough free space to
+                              write the archive or its e-mails locally
+    -manifest-out FILE        Append a JSON line describing each delivered e-mail
+                              to FILE
+    -skip-delivered           Don't deliver again the e-mails recorded as
+                              delivered in the -manifest-out file
+    -lock PATH                Lock this file while running, and quit if another
+                              instance already holds the lock
+    -lock-wait                With -lock, wait for the other instance instead
+    -otel-endpoint URL        Export OpenTelemetry traces of the login, download
+                              and delivery to this OTLP/HTTP collector, e.g.
+                              http://localhost:4318/v1/traces
+    -dump-login-pages DIR     Save the pages and forms of each login step in DIR
     -v, -verbose              Print debug informations
+    -redact                   Mask e-mail addresses, usernames, e-mail ids and
+                              folder names in the logs, e.g. to share them
+    -version                  Print version and build informations and quit
     -h, -help                 Print usage informations and quit
-`, config.Version, os.Args[0])
+`, config.Version, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	}
 
 	flag.Parse()
 
+	if config.Folders == nil {
+		config.Folders = []string{defaultFolder}
+	}
+
+	if versionFlag {
+		printVersion()
+		return
+	}
+
 	handlerOptions := slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	}
 	if verboseFlag {
 		handlerOptions.Level = slog.LevelDebug
 	}
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &handlerOptions))
+	logger := slog.New(&redactHandler{
+		Handler:  slog.NewTextHandler(os.Stdout, &handlerOptions),
+		personal: redactFlag,
+	})
 	slog.SetDefault(logger)
 
-	config.LMTPServer = flag.Arg(0)
-	if config.LMTPServer == "" {
-		slog.Error("No LMTP server provided")
+	if inspectFlag != "" {
+		err := inspect(inspectFlag)
+		if err != nil {
+			slog.Error("Couldn't inspect archive", slog.Any("error", err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	if strings.Trim(config.FolderID, "0123456789") != "" {
+		slog.Error("Folder id must be a number", slog.String("id", config.FolderID))
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if flag.NArg() > 1 {
-		slog.Error("Too many arguments")
+	if config.IDs != nil && config.Limit > 0 {
+		slog.Error("Cannot use both -ids and -limit")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if config.Username == "" {
-		slog.Error("No username provided")
+	if config.TagScope != "" {
+		if config.Tag == "" || config.FolderID != "" {
+			slog.Error("Cannot use -tag-scope without -tag, or with -folder-id")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if !slices.ContainsFunc(config.Folders, func(folder string) bool {
+			return strings.EqualFold(strings.Trim(folder, "/"), strings.Trim(config.TagScope, "/"))
+		}) {
+			slog.Error("Tag scope isn't one of the folders", slog.String("folder", config.TagScope))
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if config.TagInBackground && config.CheckpointEvery == 0 {
+		slog.Error("Cannot use -tag-in-background without -checkpoint-every")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if config.Password == "" {
-		slog.Error("No password provided")
+	// The download of the archive holds the only connection until it ends, so
+	// the e-mails couldn't be tagged before that
+	if config.MaxConns == 1 && config.CheckpointEvery > 0 && (config.Tag != "" || config.AuditTag != "") && !config.Spool && config.FromArchive == "" {
+		slog.Error("Cannot use -checkpoint-every with -max-conns 1, unless with -spool")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	// TODO: fetch address from Zimbra
-	if config.Address == "" {
-		slog.Error("No address provided")
+	if config.TagBatchSize < 1 {
+		slog.Error("Invalid tag batch size", slog.Int("size", config.TagBatchSize))
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	slog.Debug("Starting",
-		slog.String("username", config.Username),
-		slog.String("password", strings.Repeat("*", len(config.Password))),
-		slog.String("address", config.Address),
-		slog.String("LMTP server", config.LMTPServer))
+	if config.SkipDelivered && config.ManifestOut == "" {
+		slog.Error("Cannot use -skip-delivered without -manifest-out")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	client, err := zimbra.Initialize()
-	if err != nil {
-		slog.Error("Couldn't initialize Zimbra fetcher", slog.Any("error", err))
+	if _, ok := zimbra.SearchOrders[config.Order]; !ok {
+		slog.Error("Unknown order", slog.String("order", config.Order))
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	err = zimbra.Login(client)
-	if err != nil {
-		slog.Error("Couldn't login into Zimbra", slog.Any("error", err))
+	if !slices.Contains(dateSources, config.DateSource) {
+		slog.Error("Unknown date source", slog.String("source", config.DateSource))
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	archive, err := zimbra.FetchArchive(client)
-	if err != nil {
-		slog.Error("Couldn't fetch archive", slog.Any("error", err))
+	if config.ArchiveFormat != "tgz" && config.ArchiveFormat != "tar" {
+		slog.Error("Unknown archive format", slog.String("format", config.ArchiveFormat))
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	// Would it be better to request an uncompressed tar?
-	// HTTP should compress it for transport
-	zr, err := gzip.NewReader(archive)
-	if err != nil {
-		slog.Error("Couldn't read Gzip stream", slog.Any("error", err))
+	if config.SaveArchiveCompress < gzip.NoCompression || config.SaveArchiveCompress > gzip.BestCompression {
+		slog.Error("Invalid gzip level", slog.Int("level", config.SaveArchiveCompress))
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	lmtp, err := net.Dial("unix", config.LMTPServer)
-	if err != nil {
-		slog.Error("Failed to dial LTMP server", slog.Any("error", err))
+	if showQueryFlag {
+		if config.Address == "" {
+			slog.Error("No address provided, it is needed to show the query")
+			flag.Usage()
+			os.Exit(1)
+		}
+		fmt.Println(zimbra.ArchiveURL())
+		return
+	}
+
+	if config.FromArchive != "" && (config.Export != "" || listTagsFlag || config.Diff != "" || previewFlag > 0 || config.Limit > 0 || config.IDs != nil) {
+		slog.Error("Cannot use -from-archive with -export, -list-tags, -diff, -preview, -limit or -ids")
+		flag.Usage()
 		os.Exit(1)
 	}
-	defer lmtp.Close()
 
-	lmtpClient := smtp.NewClientLMTP(lmtp)
-	defer lmtpClient.Quit()
+	switch {
+	case config.Export != "":
+		formats, ok := exportFormats[config.Export]
+		if !ok {
+			slog.Error("Unknown export", slog.String("export", config.Export))
+			flag.Usage()
+			os.Exit(1)
+		}
+		if config.ExportFormat == "" {
+			config.ExportFormat = formats[0]
+		}
+		if !slices.Contains(formats, config.ExportFormat) {
+			slog.Error("Unknown export format",
+				slog.String("export", config.Export),
+				slog.String("format", config.ExportFormat))
+			flag.Usage()
+			os.Exit(1)
+		}
 
-	ids, err := deliverMails(lmtpClient, zr)
-	if err != nil {
-		slog.Error("Failed to deliver e-mails to LMTP server", slog.Any("error", err))
+		config.ExportOutput = flag.Arg(0)
+		if config.ExportOutput == "" {
+			slog.Error("No output file provided")
+			flag.Usage()
+			os.Exit(1)
+		}
+	case listTagsFlag, config.Diff != "", previewFlag > 0:
+		// Nothing is delivered
+	default:
+		switch config.Delivery {
+		case "lmtp":
+			config.LMTPServer = flag.Arg(0)
+			if config.LMTPServer == "" {
+				slog.Error("No LMTP server provided")
+				flag.Usage()
+				os.Exit(1)
+			}
+			if !validHostname(config.LMTPHostname) {
+				slog.Error("Invalid LMTP hostname", slog.String("hostname", config.LMTPHostname))
+				flag.Usage()
+				os.Exit(1)
+			}
+			if config.EnvelopeFrom != "" && !validAddress(config.EnvelopeFrom) {
+				slog.Error("Invalid envelope sender", slog.String("address", config.EnvelopeFrom))
+				flag.Usage()
+				os.Exit(1)
+			}
+			if config.EnvelopeFrom != "" && config.EnvelopeFromHeader {
+				slog.Error("Cannot use both -envelope-from and -envelope-from-header")
+				flag.Usage()
+				os.Exit(1)
+			}
+		case "imap":
+			config.IMAPServer = flag.Arg(0)
+			if config.IMAPServer == "" {
+				slog.Error("No IMAP server provided")
+				flag.Usage()
+				os.Exit(1)
+			}
+			if config.IMAPUsername == "" || config.IMAPPassword == "" {
+				slog.Error("No IMAP credentials provided")
+				flag.Usage()
+				os.Exit(1)
+			}
+			if config.EnvelopeFrom != "" || config.EnvelopeFromHeader {
+				slog.Error("Cannot use -envelope-from or -envelope-from-header with -delivery imap")
+				flag.Usage()
+				os.Exit(1)
+			}
+		case "files":
+			config.FilesDir = flag.Arg(0)
+			if config.FilesDir == "" {
+				slog.Error("No directory provided")
+				flag.Usage()
+				os.Exit(1)
+			}
+			if config.NameTemplate == "" || strings.ContainsRune(config.NameTemplate, '/') {
+				slog.Error("Invalid name template",
+					slog.String("template", config.NameTemplate))
+				flag.Usage()
+				os.Exit(1)
+			}
+			if config.EnvelopeFrom != "" || config.EnvelopeFromHeader {
+				slog.Error("Cannot use -envelope-from or -envelope-from-header with -delivery files")
+				flag.Usage()
+				os.Exit(1)
+			}
+		default:
+			slog.Error("Unknown delivery method", slog.String("delivery", config.Delivery))
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if flag.NArg() > 1 {
+		slog.Error("Too many arguments")
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	if config.Tag != "" {
-		err = zimbra.TagMails(client, ids)
+	// An archive can be imported without the webmail, unless it's to be tagged
+	// for real
+	offline := config.FromArchive != "" && (config.DryRun || config.Tag == "" && config.AuditTag == "" && config.FailTag == "" && !config.EmptyTrash)
+
+	switch {
+	case offline:
+		// Nothing is done in the webmail, so the address cannot be fetched
+		if config.Address == "" && config.Delivery == "lmtp" && !config.DryRun {
+			slog.Error("No address provided")
+			flag.Usage()
+			os.Exit(1)
+		}
+	case config.AuthCookieFile != "":
+		// The auth token replaces the credentials
+	case config.AdminUser != "":
+		if config.TargetUser == "" && config.Address == "" {
+			slog.Error("No target user provided")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if config.AdminPassword == "" {
+			slog.Error("No administrator password provided")
+			flag.Usage()
+			os.Exit(1)
+		}
+	default:
+		if config.Username == "" {
+			slog.Error("No username provided")
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		if config.Password == "" {
+			slog.Error("No password provided")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	mailbox := config.Address
+	if mailbox == "" {
+		mailbox = "your mailbox"
+	}
+	if config.EmptyTrash && !config.DryRun && !yesFlag && !confirm(fmt.Sprintf(
+		"Permanently delete everything in the Trash folder of %s after delivering?",
+		mailbox)) {
+		slog.Error("Emptying the trash wasn't confirmed")
+		os.Exit(1)
+	}
+
+	// Expanded once, so that all e-mails of a run get the same tag
+	auditTag := expandTag(config.AuditTag, time.Now())
+
+	if config.TargetUser == "" {
+		config.TargetUser = config.Address
+	}
+
+	if config.Lock != "" {
+		lock, err := lockFile(config.Lock, config.LockWait)
 		if err != nil {
-			slog.Error("Failed to tag e-mails in Zimbra",
-				slog.Any("error", err),
-				slog.String("tag", config.Tag))
+			slog.Error("Couldn't lock", slog.Any("error", err), slog.String("lock", config.Lock))
 			os.Exit(1)
 		}
+		defer lock.Close()
 	}
-}
 
-func deliverMails(client *smtp.Client, zr io.Reader) ([]string, error) {
-	var ids []string
+	logStart()
 
-	slog.Info("Reading archive")
-	tr := tar.NewReader(zr)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
+	started := time.Now()
+	// A dry run isn't a run the monitoring should know about
+	if !config.DryRun {
+		ping("/start")
+	}
+	var report *deliveryReport
+	// fail notifies the webhook of the failed run, and exits
+	fail := func(err error) {
+		if !config.DryRun {
+			notify(started, report, err)
 		}
+		os.Exit(1)
+	}
+
+	// Interrupting the run aborts the requests in flight and stops delivering,
+	// but the delivered e-mails are still tagged, unless interrupted again
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := setupTracing()
+	if err != nil {
+		slog.Error("Couldn't set up tracing", slog.Any("error", err))
+		fail(err)
+	}
+
+	var client *http.Client
+	if !offline {
+		client, err = zimbra.Initialize()
 		if err != nil {
-			return nil, fmt.Errorf("invalid tarball: %w", err)
+			slog.Error("Couldn't initialize Zimbra fetcher", slog.Any("error", err))
+			fail(err)
 		}
 
-		if hdr.Typeflag != tar.TypeReg {
-			slog.Warn("Ignoring irregular file",
-				slog.String("name", hdr.Name),
-				slog.Int("type", int(hdr.Typeflag)))
-			continue
+		if config.AuthCookieFile != "" {
+			err = zimbra.CheckAuth(ctx, client)
+		} else if config.AdminUser != "" {
+			err = zimbra.DelegateLogin(ctx, client)
+		} else {
+			err = zimbra.Login(ctx, client)
+		}
+		if errors.Is(err, zimbra.ErrBadCredentials) {
+			slog.Error("Couldn't login into Zimbra, wrong username or password", slog.Any("error", err))
+			fail(err)
+		}
+		if err != nil {
+			slog.Error("Couldn't login into Zimbra", slog.Any("error", err))
+			fail(err)
 		}
 
-		if path.Ext(hdr.Name) == ".eml" {
-			slog.Debug("Delivering e-mail", slog.String("name", hdr.Name))
-
-			err = client.Mail("", nil)
+		// -address stays an override, for the accounts with aliases
+		if config.Address == "" {
+			config.Address, err = zimbra.FetchAddress(ctx, client)
 			if err != nil {
-				return nil, fmt.Errorf("LMTP MAIL: %w", err)
+				slog.Error("Couldn't fetch address from Zimbra", slog.Any("error", err))
+				fail(err)
 			}
+			slog.Info("Fetched address", slog.String("address", config.Address))
+		}
+	}
 
-			err = client.Rcpt(config.Address, nil)
-			if err != nil {
-				return nil, fmt.Errorf("LMTP RCPT: %w", err)
-			}
+	if config.Diff != "" {
+		err = diff(ctx, client)
+		if err != nil {
+			slog.Error("Couldn't compare with manifest", slog.Any("error", err))
+			fail(err)
+		}
+		return
+	}
 
-			data, err := client.LMTPData(func(rcpt string, status *smtp.SMTPError) {
-				if status != nil {
-					slog.Warn("LMTP error", slog.String("rcpt", rcpt), slog.Any("status", *status))
-				}
-			})
-			if err != nil {
-				return nil, fmt.Errorf("LMTP DATA: %w", err)
-			}
+	if listTagsFlag {
+		err = listTags(ctx, client)
+		if err != nil {
+			slog.Error("Couldn't list tags", slog.Any("error", err))
+			fail(err)
+		}
+		return
+	}
+
+	if previewFlag > 0 {
+		err = preview(ctx, client, previewFlag)
+		if err != nil {
+			slog.Error("Couldn't preview e-mails", slog.Any("error", err))
+			fail(err)
+		}
+		return
+	}
 
-			_, err = io.Copy(data, tr)
-			closeErr := data.Close()
+	if config.Export != "" {
+		err = export(ctx, client)
+		if err != nil {
+			slog.Error("Couldn't export",
+				slog.Any("error", err),
+				slog.String("export", config.Export))
+			fail(err)
+		}
+		return
+	}
+
+	selected := config.IDs
+	if config.Limit > 0 {
+		selected, err = selectMails(ctx, client)
+		if err != nil {
+			slog.Error("Couldn't select e-mails", slog.Any("error", err))
+			fail(err)
+		}
+	}
+
+	// With -limit, there may be nothing to fetch
+	fetch := func() (io.ReadCloser, string, error) {
+		if (config.Limit > 0 || config.IDs != nil) && len(selected) == 0 {
+			return nil, "", nil
+		}
+		if config.FromArchive != "" {
+			archive, format, err := openArchive(config.FromArchive)
 			if err != nil {
-				return nil, err
+				return nil, "", err
 			}
-			if closeErr != nil {
-				return nil, fmt.Errorf("close data: %w", err)
+			config.ArchiveFormat = format
+			if info, err := os.Stat(config.FromArchive); err == nil {
+				err = checkSpace(info.Size())
+				if err != nil {
+					archive.Close()
+					return nil, "", err
+				}
 			}
+			return archive, "", nil
+		}
+		return fetchArchive(ctx, client, selected)
+	}
 
-			err = client.Reset()
-			if err != nil {
-				return nil, err
-			}
+	archive, spool, err := fetch()
+	for attempt := 1; errors.Is(err, errArchive) && attempt <= config.ArchiveRetries; attempt++ {
+		slog.Warn("Couldn't read archive, fetching it again", slog.Any("error", err), slog.Int("attempt", attempt))
+		archive, spool, err = fetch()
+	}
+	if err != nil {
+		slog.Error("Couldn't fetch archive", slog.Any("error", err))
+		fail(err)
+	}
 
-			parts := strings.Split(hdr.Name, "/")
-			name := parts[len(parts)-1]
-			id, _, found := strings.Cut(name, "-")
-			if !found {
-				slog.Error("Cannot find id in file name", slog.String("name", name))
-				continue
-			}
+	var d deliverer
+	switch {
+	case config.DryRun:
+		d = dryRunDeliverer{}
+	case config.Delivery == "lmtp":
+		d, err = newLMTPDeliverer()
+	case config.Delivery == "imap":
+		d, err = newIMAPDeliverer()
+	case config.Delivery == "files":
+		d, err = newFilesDeliverer()
+	}
+	if err != nil {
+		slog.Error("Failed to connect to delivery server",
+			slog.Any("error", err),
+			slog.String("delivery", config.Delivery))
+		fail(err)
+	}
+	defer d.Close()
 
-			id = strings.TrimLeft(id, "0")
-			ids = append(ids, id)
+	var man *manifest
+	if config.ManifestOut != "" && !config.DryRun {
+		man, err = openManifest(config.ManifestOut)
+		if err != nil {
+			slog.Error("Couldn't open manifest",
+				slog.Any("error", err),
+				slog.String("manifest", config.ManifestOut))
+			fail(err)
 		}
+		defer man.Close()
 	}
 
-	slog.Info(fmt.Sprintf("Stored %v e-mails", len(ids)))
+	deliverCtx := ctx
+	if config.MaxRuntime > 0 {
+		var cancel context.CancelFunc
+		deliverCtx, cancel = context.WithDeadlineCause(ctx, started.Add(config.MaxRuntime),
+			fmt.Errorf("run exceeded -max-runtime %v", config.MaxRuntime))
+		defer cancel()
+	}
+	// Once delivery stopped, what was delivered is still tagged
+	tagCtx := context.WithoutCancel(ctx)
+	checkpoint := func(ids []string) error {
+		return tagDelivered(tagCtx, client, ids, auditTag)
+	}
+	if config.DryRun {
+		checkpoint = func(ids []string) error { return nil }
+	}
+	var tagger *backgroundTagger
+	if config.TagInBackground && !config.DryRun {
+		tagger = startTagger(tagCtx, client, auditTag)
+		checkpoint = tagger.tag
+	}
+	report, err = deliverMails(deliverCtx, d, archive, man, checkpoint)
+	// Only if nothing was delivered yet, since the archive is read again from
+	// the start
+	for attempt := 1; errors.Is(err, errArchive) && attempt <= config.ArchiveRetries && report.Delivered+report.Skipped == 0; attempt++ {
+		slog.Warn("Couldn't read archive, fetching it again", slog.Any("error", err), slog.Int("attempt", attempt))
+		if spool != "" {
+			os.Remove(spool)
+		}
+		archive, spool, err = fetch()
+		if err == nil {
+			report, err = deliverMails(deliverCtx, d, archive, man, checkpoint)
+		}
+	}
+	if config.DryRun {
+		if spool != "" {
+			os.Remove(spool)
+		}
+		if err != nil {
+			slog.Error("Failed to read e-mails", slog.Any("error", err))
+			fail(err)
+		}
+		return
+	}
+	var batchErr error
+	if tagger != nil {
+		batchErr = tagger.wait()
+	}
+	// Even if delivery failed, and without giving up on tagging the delivered
+	// e-mails otherwise
+	if failErr := tagFailed(tagCtx, client, report.FailedIds); failErr != nil {
+		slog.Error("Failed to tag undelivered e-mails in Zimbra", slog.Any("error", failErr))
+	}
+	if err != nil {
+		slog.Error("Failed to deliver e-mails",
+			slog.Any("error", err),
+			slog.String("delivery", config.Delivery))
+		if spool != "" {
+			slog.Info("Keeping spooled archive", slog.String("file", spool))
+		}
+		if batchErr != nil {
+			slog.Error("Failed to tag e-mails in Zimbra", slog.Any("error", batchErr))
+		}
+		fail(err)
+	}
+	if config.IDs != nil {
+		missingIds(report)
+	}
+	if spool != "" && report.Truncated {
+		slog.Info("Keeping spooled archive", slog.String("file", spool))
+	} else if spool != "" {
+		os.Remove(spool)
+	}
+	// The e-mails before the last checkpoint are already tagged
+	ids := report.Ids[report.Checkpointed:]
+
+	err = errors.Join(batchErr, tagDelivered(tagCtx, client, ids, auditTag))
+	if err != nil {
+		slog.Error("Failed to tag e-mails in Zimbra", slog.Any("error", err))
+		fail(err)
+	}
+
+	if config.EmptyTrash && report.Truncated {
+		// Not everything the user expects to be delivered by now was
+		slog.Warn("Not emptying the trash, since the archive was truncated")
+	} else if config.EmptyTrash {
+		err = zimbra.EmptyTrash(tagCtx, client)
+		if err != nil {
+			slog.Error("Failed to empty trash in Zimbra", slog.Any("error", err))
+			fail(err)
+		}
+	}
+
+	err = runAfterCmd(report)
+	if err != nil {
+		slog.Error("After command failed", slog.Any("error", err))
+		fail(err)
+	}
+
+	if report.Stopped {
+		// The next run delivers the remaining e-mails
+		notify(started, report, context.Cause(ctx))
+		os.Exit(exitStopped)
+	}
+
+	notify(started, report, nil)
+}
+
+// exitStopped is the exit status of a run stopped by -max-runtime, after
+// tagging the e-mails delivered until then.
+const exitStopped = 3
+
+// logStart logs the configuration of the run.  The password is masked here
+// rather than by the log handler, so that it isn't leaked whatever the handler.
+func logStart() {
+	password := ""
+	if config.Password != "" {
+		password = "[redacted]"
+	}
+	slog.Debug("Starting",
+		slog.String("username", config.Username),
+		slog.String("password", password),
+		slog.String("address", config.Address),
+		slog.String("delivery", config.Delivery),
+		slog.String("LMTP server", config.LMTPServer),
+		slog.String("IMAP server", config.IMAPServer))
+}
+
+// confirm asks a yes/no question on the terminal.  It returns false if the
+// standard input isn't a terminal.
+func confirm(question string) bool {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	fmt.Printf("%s [y/N] ", question)
+	var answer string
+	fmt.Scanln(&answer)
+
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+}
+
+// envInt returns the integer value of the environment variable name, or def if
+// it isn't set.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid %s: %v\n", name, err)
+		os.Exit(1)
+	}
+
+	return i
+}
+
+// envCredential returns the value of the environment variable name, or else
+// the content of the systemd credential named credential in
+// $CREDENTIALS_DIRECTORY, if it exists.  The credentials listed in
+// $ZIMBRIDGE_MDA_CREDENTIALS, separated by commas, must exist.
+func envCredential(name, credential string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	required := slices.Contains(strings.Split(os.Getenv("ZIMBRIDGE_MDA_CREDENTIALS"), ","), credential)
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		if required {
+			fmt.Fprintf(os.Stderr, "Missing credential %s: $CREDENTIALS_DIRECTORY isn't set\n", credential)
+			os.Exit(1)
+		}
+		return ""
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, credential))
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return ""
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Missing credential %s: %v\n", credential, err)
+		os.Exit(1)
+	}
+
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+// envDuration returns the duration value of the environment variable name, or
+// def if it isn't set.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid %s: %v\n", name, err)
+		os.Exit(1)
+	}
+
+	return d
+}
 
-	return ids, nil
+// expandTag replaces the date and time placeholders of a tag template.
+func expandTag(template string, t time.Time) string {
+	return strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+		"%M", t.Format("04"),
+		"%S", t.Format("05"),
+		"%%", "%",
+	).Replace(template)
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"ransan.fr/zimbridge/mda/zimbra"
+)
+
+// preview prints the sender, subject and date of the n newest e-mails which
+// would be fetched.
+func preview(ctx context.Context, client *http.Client, n int) error {
+	summaries, err := zimbra.Preview(ctx, client, n)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tFROM\tSUBJECT")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Date.Format("2006-01-02 15:04"), s.From, s.Subject)
+	}
+
+	return w.Flush()
+}
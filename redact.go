@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// secretKeys are the keys of log attributes whose value is always masked.
+var secretKeys = []string{"password", "token", "cookie", "set-cookie"}
+
+// secretRegexp matches the values of the query parameters and cookies carrying
+// an authentication token, which are always masked, e.g. in URLs and errors.
+var secretRegexp = regexp.MustCompile(`(?i)([?&](?:auth|token|zauthtoken|ticket)=|ZM_AUTH_TOKEN=)[^&;\s"]*`)
+
+// personalKeys are the keys of log attributes whose value is masked with
+// -redact.
+var personalKeys = []string{
+	"address", "admin", "folder", "id", "ids", "mailbox", "name", "rcpt", "target",
+	"username", "value",
+}
+
+var addressRegexp = regexp.MustCompile(`[[:alnum:]._%+-]+@[[:alnum:].-]+`)
+
+// redactHandler masks secrets in the attributes of log records, and personal
+// informations too if personal is true.
+type redactHandler struct {
+	slog.Handler
+	personal bool
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, h.redactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redact(a))
+		return true
+	})
+
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redact(a)
+	}
+
+	return &redactHandler{Handler: h.Handler.WithAttrs(redacted), personal: h.personal}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{Handler: h.Handler.WithGroup(name), personal: h.personal}
+}
+
+func (h *redactHandler) redact(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+
+	if slices.Contains(secretKeys, strings.ToLower(a.Key)) {
+		return slog.String(a.Key, "[redacted]")
+	}
+	if h.personal && slices.Contains(personalKeys, a.Key) {
+		return slog.String(a.Key, "[redacted]")
+	}
+
+	switch v.Kind() {
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]any, len(attrs))
+		for i, a := range attrs {
+			redacted[i] = h.redact(a)
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindString, slog.KindAny:
+		// Other values are kept as they are, e.g. lists stay lists in JSON
+		s := fmt.Sprint(v.Any())
+		if redacted := h.redactString(s); redacted != s {
+			return slog.String(a.Key, redacted)
+		}
+		return slog.Attr{Key: a.Key, Value: v}
+	default:
+		return a
+	}
+}
+
+// redactString masks the authentication tokens in s, and the e-mail addresses
+// and the username with -redact.
+func (h *redactHandler) redactString(s string) string {
+	s = secretRegexp.ReplaceAllString(s, "${1}[redacted]")
+	if !h.personal {
+		return s
+	}
+
+	s = addressRegexp.ReplaceAllString(s, "[address]")
+	if config.Username != "" {
+		s = strings.ReplaceAll(s, config.Username, "[username]")
+	}
+
+	return s
+}
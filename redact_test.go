@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+func TestRedactHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(&redactHandler{Handler: slog.NewJSONHandler(&buf, nil)})
+	logger.Info("Fetching",
+		slog.Any("ids", []string{"257", "258"}),
+		slog.Int("count", 2),
+		slog.Duration("delay", time.Second),
+		slog.Any("error", errors.New("GET https://mail.etu.cyu.fr/?ticket=ST-1&service=x: EOF")),
+		slog.String("url", "https://mail.etu.cyu.fr/?id=2"),
+		slog.String("password", "hunter2"))
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"ids":      []any{"257", "258"},
+		"count":    float64(2),
+		"delay":    float64(time.Second),
+		"error":    "GET https://mail.etu.cyu.fr/?ticket=[redacted]&service=x: EOF",
+		"url":      "https://mail.etu.cyu.fr/?id=2",
+		"password": "[redacted]",
+	}
+	for key, value := range want {
+		got, _ := json.Marshal(record[key])
+		want, _ := json.Marshal(value)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestLogStartMasksPassword(t *testing.T) {
+	password := config.Password
+	defaultLogger := slog.Default()
+	t.Cleanup(func() {
+		config.Password = password
+		slog.SetDefault(defaultLogger)
+	})
+	config.Password = "hunter2"
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	for _, redact := range []bool{false, true} {
+		var buf bytes.Buffer
+		// Without redactHandler, and with it as main configures it
+		var handler slog.Handler = slog.NewTextHandler(&buf, options)
+		if redact {
+			handler = &redactHandler{Handler: handler}
+		}
+		slog.SetDefault(slog.New(handler))
+
+		logStart()
+		if !strings.Contains(buf.String(), "msg=Starting") {
+			t.Fatalf("no Starting record: %s", buf.String())
+		}
+		if strings.Contains(buf.String(), "hunter2") {
+			t.Errorf("password leaked with redactHandler %v: %s", redact, buf.String())
+		}
+	}
+}
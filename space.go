@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+var errNoSpace = errors.New("not enough free space")
+
+// expansionFactor is how much larger than the compressed archive its e-mails
+// are assumed to be once decompressed.  Text compresses better, attachments
+// hardly at all.
+const expansionFactor = 4
+
+// spaceNeeds returns how many bytes each local directory the archive of size
+// bytes, as sent, is written to needs: the spool and the saved archive, the
+// temporary copy with -order thread, and the e-mails with -delivery files.
+func spaceNeeds(size int64) map[string]int64 {
+	needs := map[string]int64{}
+	spoolDir := config.SpoolDir
+	if spoolDir == "" {
+		spoolDir = os.TempDir()
+	}
+
+	if config.SaveArchive != "" {
+		// A plain tarball is saved decompressed, unless gzipped again
+		if config.ArchiveFormat == "tgz" || config.SaveArchiveCompress > 0 {
+			needs[filepath.Dir(config.SaveArchive)] += size
+		} else {
+			needs[filepath.Dir(config.SaveArchive)] += size * expansionFactor
+		}
+	}
+	if config.Spool {
+		// A plain tarball compressed for transport is spooled decompressed
+		if config.ArchiveFormat == "tgz" {
+			needs[spoolDir] += size
+		} else {
+			needs[spoolDir] += size * expansionFactor
+		}
+	}
+	if config.Order == "thread" {
+		needs[spoolDir] += size * expansionFactor
+	}
+	if config.Delivery == "files" && !config.DryRun {
+		needs[config.FilesDir] += size * expansionFactor
+	}
+
+	return needs
+}
+
+// checkSpace fails with errNoSpace if one of the filesystems the archive of
+// size bytes is written to hasn't enough free space for it, unless
+// -no-space-check is set or size isn't known.  The needs of directories on the
+// same filesystem add up.
+func checkSpace(size int64) error {
+	if config.NoSpaceCheck || size < 0 {
+		return nil
+	}
+
+	type filesystem struct {
+		dirs      []string
+		need      int64
+		available uint64
+	}
+	filesystems := map[uint64]*filesystem{}
+	for dir, need := range spaceNeeds(size) {
+		dir = existingParent(dir)
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("cannot check free space: %w", err)
+		}
+		dev := uint64(info.Sys().(*syscall.Stat_t).Dev)
+
+		fs, ok := filesystems[dev]
+		if !ok {
+			var st syscall.Statfs_t
+			err := syscall.Statfs(dir, &st)
+			if err != nil {
+				return fmt.Errorf("cannot check free space: statfs %s: %w", dir, err)
+			}
+			fs = &filesystem{available: uint64(st.Bavail) * uint64(st.Bsize)}
+			filesystems[dev] = fs
+		}
+		fs.dirs = append(fs.dirs, dir)
+		fs.need += need
+	}
+
+	for _, fs := range filesystems {
+		slog.Debug("Checked free space",
+			slog.Any("dirs", fs.dirs),
+			slog.Int64("needed", fs.need),
+			slog.Uint64("available", fs.available))
+		if uint64(fs.need) > fs.available {
+			return fmt.Errorf("%w in %v: %v bytes needed, %v available", errNoSpace, fs.dirs, fs.need, fs.available)
+		}
+	}
+
+	return nil
+}
+
+// existingParent returns dir, or its closest parent which exists, since the
+// directories written to may only be created later.
+func existingParent(dir string) string {
+	dir = filepath.Clean(dir)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
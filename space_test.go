@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// setSpaceConfig sets the configuration spaceNeeds depends on for the
+// duration of the test, with nothing written locally.
+func setSpaceConfig(t *testing.T) {
+	t.Helper()
+
+	spool, spoolDir, save, compress, format := config.Spool, config.SpoolDir, config.SaveArchive, config.SaveArchiveCompress, config.ArchiveFormat
+	order, delivery, dir, dryRun, noCheck := config.Order, config.Delivery, config.FilesDir, config.DryRun, config.NoSpaceCheck
+	t.Cleanup(func() {
+		config.Spool, config.SpoolDir, config.SaveArchive, config.SaveArchiveCompress, config.ArchiveFormat = spool, spoolDir, save, compress, format
+		config.Order, config.Delivery, config.FilesDir, config.DryRun, config.NoSpaceCheck = order, delivery, dir, dryRun, noCheck
+	})
+
+	config.Spool, config.SpoolDir, config.SaveArchive, config.SaveArchiveCompress, config.ArchiveFormat = false, "/spool", "", 0, "tgz"
+	config.Order, config.Delivery, config.FilesDir, config.DryRun, config.NoSpaceCheck = "date", "lmtp", "", false, false
+}
+
+func TestSpaceNeeds(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func()
+		want  map[string]int64
+	}{
+		{"lmtp", func() {}, map[string]int64{}},
+		{"spool tgz", func() { config.Spool = true }, map[string]int64{"/spool": 100}},
+		{"spool tar", func() { config.Spool, config.ArchiveFormat = true, "tar" }, map[string]int64{"/spool": 400}},
+		{"thread", func() { config.Spool, config.Order = true, "thread" }, map[string]int64{"/spool": 500}},
+		{"save", func() { config.SaveArchive = "/backup/mails.tgz" }, map[string]int64{"/backup": 100}},
+		{"save tar", func() { config.SaveArchive, config.ArchiveFormat = "/backup/mails.tar", "tar" }, map[string]int64{"/backup": 400}},
+		{"save tar gzipped", func() {
+			config.SaveArchive, config.ArchiveFormat, config.SaveArchiveCompress = "/backup/mails.tgz", "tar", 6
+		}, map[string]int64{"/backup": 100}},
+		{"files", func() { config.Delivery, config.FilesDir = "files", "/mails" }, map[string]int64{"/mails": 400}},
+		{"files dry run", func() { config.Delivery, config.FilesDir, config.DryRun = "files", "/mails", true }, map[string]int64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setSpaceConfig(t)
+			test.setup()
+			if got := spaceNeeds(100); !maps.Equal(got, test.want) {
+				t.Errorf("spaceNeeds(100) = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	setSpaceConfig(t)
+	// Not created yet, like the directory given to -delivery files
+	config.Delivery, config.FilesDir = "files", filepath.Join(t.TempDir(), "mails")
+
+	if err := checkSpace(1); err != nil {
+		t.Errorf("checkSpace(1) = %v", err)
+	}
+	if err := checkSpace(-1); err != nil {
+		t.Errorf("checkSpace(-1) = %v", err)
+	}
+	if err := checkSpace(math.MaxInt64 / expansionFactor); !errors.Is(err, errNoSpace) {
+		t.Errorf("checkSpace(huge) = %v, want %v", err, errNoSpace)
+	}
+	config.NoSpaceCheck = true
+	if err := checkSpace(math.MaxInt64 / expansionFactor); err != nil {
+		t.Errorf("checkSpace(huge) with -no-space-check = %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"ransan.fr/zimbridge/mda/config"
+	"ransan.fr/zimbridge/mda/zimbra"
+)
+
+// spoolArchive downloads the whole archive into a temporary file in
+// config.SpoolDir, so that the connection to Zimbra isn't held open while
+// delivering.  The archive is closed, and the returned file is ready to be read
+// from the beginning.
+func spoolArchive(archive io.ReadCloser) (*os.File, error) {
+	defer archive.Close()
+
+	f, err := os.CreateTemp(config.SpoolDir, "zimbridge-mda-*."+config.ArchiveFormat)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create spool: %w", err)
+	}
+
+	slog.Info("Spooling archive", slog.String("file", f.Name()))
+	n, err := io.Copy(f, archive)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("%w, cannot spool archive: %w", errArchive, err)
+	}
+	slog.Debug(fmt.Sprintf("Spooled %v bytes", n), slog.String("file", f.Name()))
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("cannot rewind spool: %w", err)
+	}
+
+	return f, nil
+}
+
+// fetchArchive fetches the archive of e-mails ids, as zimbra.FetchArchive, and
+// spools it with -spool, in which case the name of the spool is returned too.
+func fetchArchive(ctx context.Context, client *http.Client, ids []string) (io.ReadCloser, string, error) {
+	archive, size, err := zimbra.FetchArchive(ctx, client, ids)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot fetch archive: %w", err)
+	}
+	if archive != nil {
+		err = checkSpace(size)
+		if err != nil {
+			archive.Close()
+			return nil, "", err
+		}
+	}
+	if config.SaveArchive != "" && archive != nil {
+		archive, err = saveArchive(archive)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if !config.Spool || archive == nil {
+		return archive, "", nil
+	}
+
+	f, err := spoolArchive(archive)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, f.Name(), nil
+}
+
+// savingReader copies the archive read through it to config.SaveArchive,
+// gzipped with -save-archive-compress if it isn't already.  The copy is only
+// kept if the whole archive was read: Close reads what is left after the end of
+// the tarball, but if delivery stopped before, e.g. once -max-runtime is
+// exceeded, the copy is dropped rather than the rest downloaded.  Failing to
+// save it doesn't prevent reading it.
+type savingReader struct {
+	archive io.ReadCloser
+	f       *os.File
+	zw      *gzip.Writer
+	w       io.Writer
+
+	eof       bool
+	abandoned bool
+	saveErr   error
+}
+
+// abandoner is implemented by the archives whose reading may be abandoned
+// before their end, rather than finished when they are closed.
+type abandoner interface {
+	abandon()
+}
+
+// saveArchive starts saving archive, in a temporary file renamed to
+// config.SaveArchive once it is complete.
+func saveArchive(archive io.ReadCloser) (*savingReader, error) {
+	f, err := os.CreateTemp(filepath.Dir(config.SaveArchive), ".zimbridge-mda-*")
+	if err != nil {
+		archive.Close()
+		return nil, fmt.Errorf("cannot save archive: %w", err)
+	}
+
+	s := &savingReader{archive: archive, f: f, w: f}
+	// A tgz archive is saved as it is
+	if config.ArchiveFormat == "tar" && config.SaveArchiveCompress > 0 {
+		s.zw, err = gzip.NewWriterLevel(f, config.SaveArchiveCompress)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			archive.Close()
+			return nil, fmt.Errorf("cannot save archive: %w", err)
+		}
+		s.w = s.zw
+	}
+
+	return s, nil
+}
+
+func (s *savingReader) Read(p []byte) (int, error) {
+	n, err := s.archive.Read(p)
+	if n > 0 && s.saveErr == nil {
+		_, s.saveErr = s.w.Write(p[:n])
+	}
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+// abandon makes Close remove the partial copy, rather than read the rest of the
+// archive, e.g. once -max-runtime is exceeded.
+func (s *savingReader) abandon() {
+	s.abandoned = true
+}
+
+// Close reads the rest of the archive, so that it is saved whole, unless it was
+// abandoned, in which case the copy is removed, and closes it.
+func (s *savingReader) Close() error {
+	if !s.eof && s.abandoned && s.saveErr == nil {
+		s.saveErr = errors.New("the archive wasn't read whole")
+	}
+	if !s.eof && s.saveErr == nil {
+		_, err := io.Copy(io.Discard, s)
+		if err != nil && s.saveErr == nil {
+			s.saveErr = err
+		}
+	}
+	if s.zw != nil && s.saveErr == nil {
+		s.saveErr = s.zw.Close()
+	}
+	if err := s.f.Close(); err != nil && s.saveErr == nil {
+		s.saveErr = err
+	}
+	if s.saveErr == nil {
+		s.saveErr = os.Rename(s.f.Name(), config.SaveArchive)
+	}
+
+	if s.saveErr != nil {
+		os.Remove(s.f.Name())
+		slog.Warn("Couldn't save archive",
+			slog.Any("error", s.saveErr),
+			slog.String("file", config.SaveArchive))
+	} else {
+		slog.Info("Saved archive", slog.String("file", config.SaveArchive))
+	}
+
+	return s.archive.Close()
+}
+
+// openArchive opens the archive saved at name, and returns its format, "tgz"
+// if it is gzipped or else "tar".
+func openArchive(name string) (io.ReadCloser, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	br := bufio.NewReader(f)
+	format := "tar"
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		format = "tgz"
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, f}, format, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// waitingDeliverer delivers the e-mails it is given once ctx is done.
+type waitingDeliverer struct {
+	delivered int
+}
+
+func (d *waitingDeliverer) deliver(ctx context.Context, m *message) error {
+	<-ctx.Done()
+	d.delivered++
+	return nil
+}
+
+func (d *waitingDeliverer) Close() error {
+	return nil
+}
+
+func TestSavedArchiveAbandonedOnDeadline(t *testing.T) {
+	setTestConfig(t)
+	save, compress := config.SaveArchive, config.SaveArchiveCompress
+	t.Cleanup(func() { config.SaveArchive, config.SaveArchiveCompress = save, compress })
+	dir := t.TempDir()
+	config.SaveArchive, config.SaveArchiveCompress = filepath.Join(dir, "archive.tar"), 0
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := range 10 {
+		body := append([]byte("Subject: Hello\r\n\r\n"), bytes.Repeat([]byte("Hello\r\n"), 30_000)...)
+		err := tw.WriteHeader(&tar.Header{
+			Name:     "Inbox/" + strconv.Itoa(257+i) + "-Hello.eml",
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(body)),
+			ModTime:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	download := &countingReader{r: bytes.NewReader(buf.Bytes())}
+	archive, err := saveArchive(io.NopCloser(download))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	d := &waitingDeliverer{}
+	report, err := deliverMails(ctx, d, archive, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Stopped || d.delivered != 1 {
+		t.Errorf("stopped = %v after %v e-mails, want after 1", report.Stopped, d.delivered)
+	}
+	if download.n >= int64(buf.Len()) {
+		t.Errorf("read %v bytes of the download, want less than %v", download.n, buf.Len())
+	}
+	if _, err := os.Stat(config.SaveArchive); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial archive saved: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+}
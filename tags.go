@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"ransan.fr/zimbridge/mda/config"
+	"ransan.fr/zimbridge/mda/zimbra"
+)
+
+// listTags prints the name, id and number of e-mails of each tag.
+func listTags(ctx context.Context, client *http.Client) error {
+	tags, err := zimbra.Tags(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tCOUNT")
+	for _, tag := range tags {
+		fmt.Fprintf(w, "%s\t%s\t%v\n", tag.Name, tag.Id, tag.Count)
+	}
+
+	return w.Flush()
+}
+
+// tagDelivered tags the delivered e-mails ids with -tag, except those already
+// tagged with -verify-tags, and with the expanded -audit-tag.
+func tagDelivered(ctx context.Context, client *http.Client, ids []string, auditTag string) error {
+	toTag := ids
+	if config.Tag != "" && config.VerifyTags && len(toTag) > 0 {
+		untagged, err := zimbra.FilterTagged(ctx, client, toTag)
+		if err != nil {
+			return fmt.Errorf("cannot check e-mails tagged with %s: %w", config.Tag, err)
+		}
+		slog.Info(fmt.Sprintf("%v e-mails are already tagged", len(toTag)-len(untagged)))
+		toTag = untagged
+	}
+
+	if config.Tag != "" && len(toTag) > 0 {
+		tagged, err := zimbra.TagMails(ctx, client, config.Tag, toTag)
+		if err != nil {
+			return fmt.Errorf("cannot tag %v of %v e-mails with %s: %w", len(toTag)-len(tagged), len(toTag), config.Tag, err)
+		}
+		slog.Info(fmt.Sprintf("Tagged %v e-mails", len(toTag)))
+	}
+
+	if auditTag != "" && len(ids) > 0 {
+		err := zimbra.CreateTag(ctx, client, auditTag)
+		if err != nil {
+			return fmt.Errorf("cannot tag e-mails with %s: %w", auditTag, err)
+		}
+		tagged, err := zimbra.TagMails(ctx, client, auditTag, ids)
+		if err != nil {
+			return fmt.Errorf("cannot tag %v of %v e-mails with %s: %w", len(ids)-len(tagged), len(ids), auditTag, err)
+		}
+		slog.Info(fmt.Sprintf("Tagged %v e-mails", len(ids)), slog.String("tag", auditTag))
+	}
+
+	return nil
+}
+
+// backgroundTagger tags batches of delivered e-mails in the background, one
+// batch at a time, while the next e-mails are delivered.
+type backgroundTagger struct {
+	batches chan []string
+	done    chan struct{}
+	// Errors tagging the batches, only read once done is closed
+	errs []error
+}
+
+// maxPendingBatches is the number of batches waiting to be tagged beyond which
+// delivery waits too.
+const maxPendingBatches = 4
+
+func startTagger(ctx context.Context, client *http.Client, auditTag string) *backgroundTagger {
+	t := &backgroundTagger{
+		batches: make(chan []string, maxPendingBatches),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(t.done)
+		for ids := range t.batches {
+			err := tagDelivered(ctx, client, ids, auditTag)
+			if err != nil {
+				slog.Warn("Failed to tag a batch of e-mails, still delivering the next ones",
+					slog.Any("error", err),
+					slog.Int("count", len(ids)))
+				t.errs = append(t.errs, err)
+			}
+		}
+	}()
+
+	return t
+}
+
+// tag queues the delivered e-mails ids to be tagged.
+func (t *backgroundTagger) tag(ids []string) error {
+	t.batches <- slices.Clone(ids)
+	return nil
+}
+
+// wait waits for every queued batch to be tagged, and returns the errors
+// tagging them.
+func (t *backgroundTagger) wait() error {
+	close(t.batches)
+	<-t.done
+	return errors.Join(t.errs...)
+}
+
+// tagFailed tags the e-mails ids which weren't delivered with -fail-tag.
+func tagFailed(ctx context.Context, client *http.Client, ids []string) error {
+	if config.FailTag == "" || len(ids) == 0 {
+		return nil
+	}
+
+	err := zimbra.CreateTag(ctx, client, config.FailTag)
+	if err != nil {
+		return fmt.Errorf("cannot tag e-mails with %s: %w", config.FailTag, err)
+	}
+	tagged, err := zimbra.TagMails(ctx, client, config.FailTag, ids)
+	if err != nil {
+		return fmt.Errorf("cannot tag %v of %v e-mails with %s: %w", len(ids)-len(tagged), len(ids), config.FailTag, err)
+	}
+	slog.Info(fmt.Sprintf("Tagged %v undelivered e-mails", len(ids)), slog.String("tag", config.FailTag))
+
+	return nil
+}
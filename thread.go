@@ -0,0 +1,187 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// threadedArchive is a copy of the archive, uncompressed, whose entries are
+// read in the order of their threads with -order thread.
+type threadedArchive struct {
+	f       *os.File
+	entries []*threadEntry
+}
+
+type threadEntry struct {
+	hdr    *tar.Header
+	offset int64
+
+	messageId string
+	// Message-Ids of the ancestors, the closest first
+	ancestors []string
+	date      time.Time
+}
+
+// readThreads copies the archive read from r into a temporary file in
+// config.SpoolDir, and orders its e-mails thread by thread, each parent before
+// its children according to their In-Reply-To and References headers, and the
+// threads by date.  Only the headers of the e-mails are kept in memory.  If the
+// archive is corrupt, the entries before the corrupt part are kept along with
+// the error.
+func readThreads(r io.Reader) (*threadedArchive, error) {
+	f, err := os.CreateTemp(config.SpoolDir, "zimbridge-mda-*.tar")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create spool: %w", err)
+	}
+	// The file stays readable until it's closed
+	os.Remove(f.Name())
+
+	slog.Info("Reading headers of the archive", slog.String("file", f.Name()))
+	t := &threadedArchive{f: f}
+	copied := &countingReader{r: io.TeeReader(r, f)}
+	tr := tar.NewReader(copied)
+	var metas, mails []*threadEntry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = tarballError(err)
+			t.entries = append(metas, sortThreads(mails)...)
+			return t, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		e := &threadEntry{hdr: hdr, offset: copied.n, date: hdr.ModTime}
+		switch path.Ext(hdr.Name) {
+		case ".meta":
+			metas = append(metas, e)
+		case ".eml":
+			header, _ := textproto.NewReader(bufio.NewReader(tr)).ReadMIMEHeader()
+			e.messageId = strings.TrimSpace(header.Get("Message-Id"))
+			// References lists the ancestors from the oldest
+			references := messageIds(header.Get("References"))
+			slices.Reverse(references)
+			e.ancestors = append(messageIds(header.Get("In-Reply-To")), references...)
+			if date, err := mail.ParseDate(header.Get("Date")); err == nil {
+				e.date = date
+			}
+			mails = append(mails, e)
+		}
+	}
+
+	// The metadata come first, so that the flags are known for every e-mail
+	t.entries = append(metas, sortThreads(mails)...)
+	return t, nil
+}
+
+// next returns the next entry of the archive, or io.EOF.
+func (t *threadedArchive) next() (*tar.Header, io.Reader, error) {
+	if len(t.entries) == 0 {
+		return nil, nil, io.EOF
+	}
+
+	e := t.entries[0]
+	t.entries = t.entries[1:]
+	return e.hdr, io.NewSectionReader(t.f, e.offset, e.hdr.Size), nil
+}
+
+func (t *threadedArchive) Close() error {
+	return t.f.Close()
+}
+
+// messageIds returns the message ids in s, like "<a@b> <c@d>".
+func messageIds(s string) []string {
+	var ids []string
+	for _, field := range strings.Fields(s) {
+		if strings.HasPrefix(field, "<") && strings.HasSuffix(field, ">") {
+			ids = append(ids, field)
+		}
+	}
+	return ids
+}
+
+// sortThreads orders mails thread by thread, under the closest ancestor of
+// each e-mail present in mails.
+func sortThreads(mails []*threadEntry) []*threadEntry {
+	byId := make(map[string]*threadEntry, len(mails))
+	for _, e := range mails {
+		if _, found := byId[e.messageId]; e.messageId != "" && !found {
+			byId[e.messageId] = e
+		}
+	}
+
+	children := make(map[string][]*threadEntry)
+	var roots []*threadEntry
+	for _, e := range mails {
+		var parent string
+		for _, id := range e.ancestors {
+			if byId[id] != nil && id != e.messageId {
+				parent = id
+				break
+			}
+		}
+
+		if parent == "" {
+			roots = append(roots, e)
+		} else {
+			children[parent] = append(children[parent], e)
+		}
+	}
+
+	byDate := func(a, b *threadEntry) int { return a.date.Compare(b.date) }
+	slices.SortStableFunc(roots, byDate)
+
+	sorted := make([]*threadEntry, 0, len(mails))
+	visited := make(map[*threadEntry]bool, len(mails))
+	var visit func(e *threadEntry)
+	visit = func(e *threadEntry) {
+		if visited[e] {
+			return
+		}
+		visited[e] = true
+		sorted = append(sorted, e)
+
+		// Only the first e-mail with a given Message-Id gets the children
+		if byId[e.messageId] != e {
+			return
+		}
+		kids := children[e.messageId]
+		slices.SortStableFunc(kids, byDate)
+		for _, kid := range kids {
+			visit(kid)
+		}
+	}
+	for _, e := range roots {
+		visit(e)
+	}
+
+	// E-mails in a cycle of references have no root
+	var orphans []*threadEntry
+	for _, e := range mails {
+		if !visited[e] {
+			orphans = append(orphans, e)
+		}
+	}
+	slices.SortStableFunc(orphans, byDate)
+	for _, e := range orphans {
+		visit(e)
+	}
+
+	return sorted
+}
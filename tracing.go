@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"ransan.fr/zimbridge/mda/config"
+)
+
+var tracer = otel.Tracer("ransan.fr/zimbridge/mda")
+
+// setupTracing exports spans over OTLP/HTTP to config.OTelEndpoint.  Spans are
+// exported as soon as they end, since main exits without flushing on errors.
+// Without an endpoint, the default tracer provider drops every span.
+func setupTracing() error {
+	if config.OTelEndpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(config.OTelEndpoint))
+	if err != nil {
+		return fmt.Errorf("cannot create OTLP exporter: %w", err)
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "zimbridge-mda"),
+			attribute.String("service.version", config.Version),
+		)),
+	))
+
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// printVersion prints config.Version, or else the module version, and the
+// build informations embedded by the Go toolchain.
+func printVersion() {
+	info, ok := debug.ReadBuildInfo()
+
+	version := config.Version
+	if version == "" && ok {
+		version = info.Main.Version
+	}
+	fmt.Printf("zimbridge-mda %s\n", version)
+	if !ok {
+		return
+	}
+
+	fmt.Printf("go: %s\n", info.GoVersion)
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			fmt.Printf("%s: %s\n", setting.Key, setting.Value)
+		}
+	}
+}
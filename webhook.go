@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// webhookTimeout bounds the request to the webhook, so that it doesn't hold up
+// the end of the run.
+const webhookTimeout = 10 * time.Second
+
+// runSummary is posted to the webhook at the end of a run.
+type runSummary struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Started   time.Time `json:"started"`
+	Duration  string    `json:"duration"`
+	Seen      int       `json:"seen"`
+	Delivered int       `json:"delivered"`
+	Skipped   int       `json:"skipped"`
+	Failed    int       `json:"failed"`
+	Ignored   int       `json:"ignored"`
+	NoMatch   bool      `json:"no_match"`
+}
+
+// pingTimeout bounds the requests to the ping URL.
+const pingTimeout = 5 * time.Second
+
+// notify posts the summary of the run started at started to config.Webhook,
+// and pings config.PingURL, if set.  The report is nil if the run failed
+// before delivering.  Failures are only logged.
+func notify(started time.Time, report *deliveryReport, err error) {
+	if err != nil {
+		ping("/fail")
+	} else {
+		ping("")
+	}
+
+	if config.Webhook == "" {
+		return
+	}
+
+	summary := runSummary{
+		Status:   "success",
+		Started:  started,
+		Duration: time.Since(started).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		summary.Status = "failure"
+		summary.Error = err.Error()
+	}
+	if report != nil {
+		summary.Seen = report.Seen
+		summary.Delivered = report.Delivered
+		summary.Skipped = report.Skipped
+		summary.Failed = report.Failed
+		summary.Ignored = report.Ignored
+		summary.NoMatch = report.NoMatch
+	}
+
+	err = postWebhook(summary)
+	if err != nil {
+		slog.Warn("Couldn't notify webhook", slog.Any("error", err))
+	}
+}
+
+func postWebhook(summary runSummary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", config.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(config.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Zimbridge-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	slog.Debug("Notifying webhook", slog.String("url", config.Webhook))
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", config.Webhook, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: unexpected status code: %v", config.Webhook, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// ping requests config.PingURL followed by suffix, if set, e.g. "/start" when
+// the run starts, as expected by healthchecks.io.  Failures are only logged.
+func ping(suffix string) {
+	if config.PingURL == "" {
+		return
+	}
+
+	url := strings.TrimSuffix(config.PingURL, "/") + suffix
+	slog.Debug("Pinging", slog.String("url", url))
+	client := &http.Client{Timeout: pingTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		slog.Warn("Couldn't ping", slog.Any("error", err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		slog.Warn("Couldn't ping", slog.String("url", url), slog.Int("status", resp.StatusCode))
+	}
+}
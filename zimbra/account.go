@@ -0,0 +1,35 @@
+package zimbra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// FetchAddress returns the primary e-mail address of the account logged in.
+func FetchAddress(ctx context.Context, client *http.Client) (string, error) {
+	url := "https://mail.etu.cyu.fr/service/soap"
+
+	slog.Debug("Fetching address", slog.String("url", url))
+	var body struct {
+		GetInfoResponse *struct {
+			Name string `json:"name"`
+		}
+	}
+	err := soapRequest(ctx, client, url, nil, map[string]any{
+		"GetInfoRequest": map[string]any{
+			"_jsns": "urn:zimbraAccount",
+			// Leaves out the preferences, attributes, signatures...
+			"sections": "mbox",
+		},
+	}, &body)
+	if err != nil {
+		return "", fmt.Errorf("GetInfoRequest: %w", err)
+	}
+	if body.GetInfoResponse == nil || body.GetInfoResponse.Name == "" {
+		return "", fmt.Errorf("GetInfoRequest: no info response")
+	}
+
+	return body.GetInfoResponse.Name, nil
+}
@@ -0,0 +1,73 @@
+package zimbra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// DelegateLogin authenticates with the administrator account, and obtains a
+// delegated auth token for the target account, used for all further requests
+// to the webmail.
+func DelegateLogin(ctx context.Context, client *http.Client) error {
+	slog.Info("Authenticating as administrator",
+		slog.String("url", config.AdminURL),
+		slog.String("admin", config.AdminUser))
+
+	var authBody struct {
+		AuthResponse *struct {
+			AuthToken []content `json:"authToken"`
+		}
+	}
+	err := soapRequest(ctx, client, config.AdminURL, nil, map[string]any{
+		"AuthRequest": map[string]any{
+			"_jsns":    "urn:zimbraAdmin",
+			"name":     config.AdminUser,
+			"password": config.AdminPassword,
+		},
+	}, &authBody)
+	if err != nil {
+		return fmt.Errorf("AuthRequest: %w", err)
+	}
+	if authBody.AuthResponse == nil || len(authBody.AuthResponse.AuthToken) == 0 {
+		return fmt.Errorf("AuthRequest: no auth token in response")
+	}
+	adminToken := authBody.AuthResponse.AuthToken[0].Content
+
+	slog.Info("Delegating authentication", slog.String("target", config.TargetUser))
+	var delegateBody struct {
+		DelegateAuthResponse *struct {
+			AuthToken []content `json:"authToken"`
+		}
+	}
+	err = soapRequest(ctx, client, config.AdminURL, map[string]any{
+		"context": map[string]any{
+			"_jsns":     "urn:zimbra",
+			"authToken": content{adminToken},
+		},
+	}, map[string]any{
+		"DelegateAuthRequest": map[string]any{
+			"_jsns": "urn:zimbraAdmin",
+			"account": map[string]any{
+				"by":       "name",
+				"_content": config.TargetUser,
+			},
+		},
+	}, &delegateBody)
+	if err != nil {
+		return fmt.Errorf("DelegateAuthRequest: %w", err)
+	}
+	if delegateBody.DelegateAuthResponse == nil || len(delegateBody.DelegateAuthResponse.AuthToken) == 0 {
+		return fmt.Errorf("DelegateAuthRequest: no auth token in response")
+	}
+
+	// The webmail reads the auth token from this cookie, as if the target
+	// user had logged in themselves
+	setAuthToken(client.Jar, delegateBody.DelegateAuthResponse.AuthToken[0].Content)
+	slog.Debug("Got delegated auth token", slog.String("target", config.TargetUser))
+
+	return nil
+}
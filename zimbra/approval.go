@@ -0,0 +1,130 @@
+package zimbra
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// defaultApprovalPollDelay is how often a page waiting for approval is polled,
+// unless the page asks to be refreshed at another pace.
+const defaultApprovalPollDelay = 5 * time.Second
+
+// awaitApproval returns resp if it leads to the webmail or contains a login
+// form.  Otherwise, resp is assumed to be a page waiting for a second factor to
+// be approved, e.g. on a phone, and it is polled until it contains a form or
+// leads to the webmail, or config.ApprovalTimeout elapses.
+func awaitApproval(ctx context.Context, client *http.Client, resp *http.Response) (*http.Response, error) {
+	if config.ApprovalTimeout == 0 {
+		return resp, nil
+	}
+
+	deadline := time.Now().Add(config.ApprovalTimeout)
+	for {
+		if resp.Request.URL.Host == "mail.etu.cyu.fr" {
+			return resp, nil
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read login page: %w", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+
+		doc, err := html.Parse(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse login page: %w", err)
+		}
+		if _, _, err := formInfo(doc); err == nil {
+			return resp, nil
+		}
+
+		pollUrl, delay := refreshInfo(doc, resp.Request.URL)
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("second factor not approved after %v", config.ApprovalTimeout)
+		}
+
+		slog.Info("Waiting for second factor approval",
+			slog.String("url", pollUrl),
+			slog.Duration("remaining", time.Until(deadline).Round(time.Second)))
+		err = sleep(ctx, delay)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err = get(ctx, client, pollUrl)
+		if err != nil {
+			return nil, fmt.Errorf("GET %s: %w", pollUrl, err)
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("GET %s: unexpected status code: %v", pollUrl, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("content-type"); !strings.HasPrefix(ct, "text/html") {
+			return nil, fmt.Errorf("GET %s: unexpected content-type: %s", pollUrl, ct)
+		}
+	}
+}
+
+// refreshInfo returns the URL and delay of the page's
+// <meta http-equiv="refresh">, defaulting to the page itself and
+// defaultApprovalPollDelay.
+func refreshInfo(doc *html.Node, base *url.URL) (string, time.Duration) {
+	pollUrl := base.String()
+	delay := defaultApprovalPollDelay
+
+	content, found := metaRefresh(doc)
+	if !found {
+		return pollUrl, delay
+	}
+
+	seconds, target, _ := strings.Cut(content, ";")
+	if s, err := strconv.Atoi(strings.TrimSpace(seconds)); err == nil && s > 0 {
+		delay = time.Duration(s) * time.Second
+	}
+	target = strings.TrimSpace(target)
+	if len(target) > 4 && strings.EqualFold(target[:4], "url=") {
+		if parsed, err := url.Parse(strings.Trim(target[4:], `'"`)); err == nil {
+			pollUrl = base.ResolveReference(parsed).String()
+		}
+	}
+
+	return pollUrl, delay
+}
+
+// metaRefresh returns the content of the first <meta http-equiv="refresh">.
+func metaRefresh(n *html.Node) (string, bool) {
+	if n.Type == html.ElementNode && n.Data == "meta" {
+		var httpEquiv, content string
+		for _, a := range n.Attr {
+			switch a.Key {
+			case "http-equiv":
+				httpEquiv = a.Val
+			case "content":
+				content = a.Val
+			}
+		}
+
+		if strings.EqualFold(httpEquiv, "refresh") {
+			return content, true
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if content, found := metaRefresh(c); found {
+			return content, true
+		}
+	}
+
+	return "", false
+}
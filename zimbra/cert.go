@@ -0,0 +1,37 @@
+package zimbra
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"sync"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// warnedHosts are the hosts whose certificate was already warned about, so
+// that it is done once per host instead of once per connection.
+var warnedHosts sync.Map
+
+// checkCertExpiry warns if the certificate of the server expires within
+// config.CertWarnDays.  It never fails the connection.
+func checkCertExpiry(cs tls.ConnectionState) error {
+	if config.CertWarnDays <= 0 || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+
+	leaf := cs.PeerCertificates[0]
+	days := int(time.Until(leaf.NotAfter).Hours() / 24)
+	if days >= config.CertWarnDays {
+		return nil
+	}
+	if _, warned := warnedHosts.LoadOrStore(cs.ServerName, true); warned {
+		return nil
+	}
+
+	slog.Warn("TLS certificate of the server expires soon",
+		slog.String("host", cs.ServerName),
+		slog.Time("expires", leaf.NotAfter),
+		slog.Int("days", days))
+	return nil
+}
@@ -0,0 +1,117 @@
+package zimbra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// authCookie is the name of the cookie holding the auth token of the webmail.
+const authCookie = "ZM_AUTH_TOKEN"
+
+var webmailURL = &url.URL{Scheme: "https", Host: "mail.etu.cyu.fr", Path: "/"}
+
+// setAuthToken makes all further requests to the webmail authenticated with
+// token.
+func setAuthToken(jar http.CookieJar, token string) {
+	jar.SetCookies(webmailURL, []*http.Cookie{{
+		Name:  authCookie,
+		Value: token,
+		Path:  "/",
+	}})
+}
+
+// readAuthCookieFile reads the auth token from a file, which may contain only
+// the token, a NAME=VALUE cookie, or be in the Netscape cookies.txt format
+// browser extensions export.
+func readAuthCookieFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if fields := strings.Split(line, "\t"); len(fields) == 7 {
+			if fields[5] == authCookie {
+				return fields[6], nil
+			}
+			continue
+		}
+
+		if value, found := strings.CutPrefix(line, authCookie+"="); found {
+			return value, nil
+		}
+
+		if len(lines) == 1 {
+			return line, nil
+		}
+	}
+
+	return "", fmt.Errorf("no %s cookie in %s", authCookie, path)
+}
+
+// CheckAuth checks that the auth token is still accepted by the webmail.
+func CheckAuth(ctx context.Context, client *http.Client) error {
+	url := "https://mail.etu.cyu.fr/service/soap"
+
+	slog.Info("Checking auth token")
+	var body struct {
+		NoOpResponse *struct{}
+	}
+	err := soapRequest(ctx, client, url, nil, map[string]any{
+		"NoOpRequest": map[string]any{
+			"_jsns": "urn:zimbraMail",
+		},
+	}, &body)
+	if err == nil && body.NoOpResponse == nil {
+		err = fmt.Errorf("no NoOp response")
+	}
+	if err != nil {
+		return fmt.Errorf("auth token expired or invalid, export it again from your browser: %w", err)
+	}
+	slog.Debug("Checked auth token")
+
+	return nil
+}
+
+// authJar is a cookie jar which makes sure the auth token reaches the webmail.
+// The token may be set on a redirect with Domain, Path or SameSite attributes
+// which keep the jar from sending it back to the webmail, so it is also stored
+// for the webmail as is.
+type authJar struct {
+	http.CookieJar
+}
+
+func (j *authJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.CookieJar.SetCookies(u, cookies)
+
+	names := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		names[i] = cookie.Name
+		if cookie.Name == authCookie && cookie.Value != "" && u.Host != webmailURL.Host {
+			slog.Debug("Got auth token from another host", slog.String("host", u.Host))
+			setAuthToken(j.CookieJar, cookie.Value)
+		}
+	}
+	slog.Debug("Got cookies", slog.String("host", u.Host), slog.Any("names", names))
+}
+
+// hasAuthToken reports whether the jar holds an auth token for the webmail.
+func hasAuthToken(jar http.CookieJar) bool {
+	for _, cookie := range jar.Cookies(webmailURL) {
+		if cookie.Name == authCookie && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
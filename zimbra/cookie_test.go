@@ -0,0 +1,45 @@
+package zimbra
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestAuthJarMultipleHosts(t *testing.T) {
+	var restCookies []*http.Cookie
+	client := newTestClient(t, map[string]http.Handler{
+		"auth.u-cergy.fr": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Scoped to the CAS, so the jar alone wouldn't send it to the
+			// webmail
+			http.SetCookie(w, &http.Cookie{Name: authCookie, Value: "token", Path: "/cas", SameSite: http.SameSiteStrictMode})
+			http.SetCookie(w, &http.Cookie{Name: "TGC", Value: "ticket", Path: "/cas"})
+		}),
+		"mail.etu.cyu.fr": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "session", Path: "/zimbra"})
+				return
+			}
+			restCookies = r.Cookies()
+		}),
+	})
+
+	for _, url := range []string{
+		"https://mail.etu.cyu.fr/",
+		"https://auth.u-cergy.fr/cas/login",
+		"https://mail.etu.cyu.fr/home/user@etu.cyu.fr/inbox",
+	} {
+		resp, err := get(context.Background(), client, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if !hasAuthToken(client.Jar) {
+		t.Error("the jar has no auth token for the webmail")
+	}
+	if len(restCookies) != 1 || restCookies[0].Name != authCookie || restCookies[0].Value != "token" {
+		t.Errorf("cookies sent to the REST host = %v, want only %s=token", restCookies, authCookie)
+	}
+}
@@ -0,0 +1,78 @@
+package zimbra
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// dumpLoginPage saves the body of a login step's response in
+// config.DumpLoginPages, if set.  The body stays readable from resp.
+func dumpLoginPage(step int, resp *http.Response) error {
+	if config.DumpLoginPages == "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("cannot read login page: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	name := filepath.Join(config.DumpLoginPages, fmt.Sprintf("%02d-%s.html", step, resp.Request.URL.Host))
+	err = writeDump(name, body)
+	if err != nil {
+		return fmt.Errorf("cannot dump login page: %w", err)
+	}
+	slog.Debug("Dumped login page", slog.String("file", name))
+
+	return nil
+}
+
+// dumpLoginRequest saves the form about to be posted by a login step in
+// config.DumpLoginPages, if set, with the password redacted.
+func dumpLoginRequest(step int, actionUrl string, inputs url.Values) error {
+	if config.DumpLoginPages == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "POST %s\n\n", actionUrl)
+	for name, values := range inputs {
+		for _, value := range values {
+			if name == "password" {
+				// Not even its length is given away
+				value = "[redacted]"
+			}
+			fmt.Fprintf(&b, "%s=%s\n", name, value)
+		}
+	}
+
+	name := filepath.Join(config.DumpLoginPages, fmt.Sprintf("%02d-request.txt", step))
+	err := writeDump(name, []byte(b.String()))
+	if err != nil {
+		return fmt.Errorf("cannot dump login request: %w", err)
+	}
+	slog.Debug("Dumped login request", slog.String("file", name))
+
+	return nil
+}
+
+// writeDump writes data to the file name, creating config.DumpLoginPages if it
+// doesn't exist yet.
+func writeDump(name string, data []byte) error {
+	err := os.MkdirAll(config.DumpLoginPages, 0o700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0600)
+}
@@ -0,0 +1,37 @@
+package zimbra
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+func TestDumpLoginRequest(t *testing.T) {
+	dir := config.DumpLoginPages
+	t.Cleanup(func() { config.DumpLoginPages = dir })
+	// Not created yet
+	config.DumpLoginPages = filepath.Join(t.TempDir(), "login")
+
+	err := dumpLoginRequest(1, "https://auth.u-cergy.fr/cas/login", url.Values{
+		"username": {"user"},
+		"password": {"hunter2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dump, err := os.ReadFile(filepath.Join(config.DumpLoginPages, "01-request.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dump), "hunter2") || strings.Contains(string(dump), "*******") {
+		t.Errorf("password not redacted:\n%s", dump)
+	}
+	if !strings.Contains(string(dump), "password=[redacted]\n") {
+		t.Errorf("password missing:\n%s", dump)
+	}
+}
@@ -0,0 +1,42 @@
+package zimbra
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// FetchExport requests the export of a folder, e.g. calendar or contacts, in
+// the given format.  It returns an empty reader if the folder is empty.
+func FetchExport(ctx context.Context, client *http.Client, folder, format string) (io.ReadCloser, error) {
+	url := "https://mail.etu.cyu.fr/home/" + config.Address + "/" + folder + "?fmt=" + format
+
+	slog.Info("Requesting export", slog.String("url", url))
+	resp, err := doRetried(ctx, bounded(client), func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", url, err)
+	}
+	if resp.StatusCode == 204 {
+		resp.Body.Close()
+		slog.Debug("Got empty export", slog.Any("url", resp.Request.URL))
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: unexpected status code: %v", url, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("content-type"); strings.HasPrefix(ct, "text/html") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: unexpected content-type: %s", url, ct)
+	}
+	slog.Debug("Got export", slog.Any("url", resp.Request.URL))
+
+	return resp.Body, nil
+}
@@ -0,0 +1,44 @@
+package zimbra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// FolderID returns the id of the folder at path, like "Inbox" or
+// "Projects/Archive".
+func FolderID(ctx context.Context, client *http.Client, path string) (string, error) {
+	url := "https://mail.etu.cyu.fr/service/soap"
+
+	slog.Debug("Resolving folder", slog.String("url", url), slog.String("folder", path))
+	var body struct {
+		GetFolderResponse *struct {
+			Folder []struct {
+				Id   string `json:"id"`
+				Path string `json:"absFolderPath"`
+			} `json:"folder"`
+		}
+	}
+	err := soapRequest(ctx, client, url, nil, map[string]any{
+		"GetFolderRequest": map[string]any{
+			"_jsns": "urn:zimbraMail",
+			"depth": 0,
+			"folder": map[string]any{
+				"path": "/" + strings.TrimPrefix(path, "/"),
+			},
+		},
+	}, &body)
+	if err != nil {
+		return "", fmt.Errorf("GetFolderRequest: %w", err)
+	}
+	if body.GetFolderResponse == nil || len(body.GetFolderResponse.Folder) == 0 {
+		return "", fmt.Errorf("GetFolderRequest: no folder response")
+	}
+	folder := body.GetFolderResponse.Folder[0]
+	slog.Debug("Resolved folder", slog.String("folder", folder.Path), slog.String("id", folder.Id))
+
+	return folder.Id, nil
+}
@@ -0,0 +1,60 @@
+package zimbra
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// allowedHosts are the hosts of the webmail and of the CAS, which the client may
+// be redirected to, and post login forms to, along with the host of
+// config.AdminURL and config.AllowedHosts.
+var allowedHosts = []string{"mail.etu.cyu.fr", "auth.u-cergy.fr"}
+
+// maxRedirects is the number of redirects followed in a row, like the default
+// of http.Client.
+const maxRedirects = 10
+
+// hostAllowed reports whether the client may connect to the host of u.
+func hostAllowed(u *url.URL) bool {
+	host := u.Hostname()
+	if admin, err := url.Parse(config.AdminURL); err == nil && admin.Hostname() == host {
+		return true
+	}
+	return slices.Contains(allowedHosts, host) || slices.Contains(config.AllowedHosts, host)
+}
+
+// checkRedirect only follows redirects to allowed hosts, so that the client
+// doesn't end up posting credentials anywhere else.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %v redirects", maxRedirects)
+	}
+
+	slog.Debug("Following redirect",
+		slog.String("from", withoutQuery(via[len(via)-1].URL)),
+		slog.String("to", withoutQuery(req.URL)))
+	if !hostAllowed(req.URL) {
+		return fmt.Errorf("%w %s, which -allow-host may allow", errUnexpectedHost, req.URL.Hostname())
+	}
+
+	return nil
+}
+
+// errUnexpectedHost is returned when the client would connect to a host which
+// isn't allowed.
+var errUnexpectedHost = errors.New("unexpected host")
+
+// withoutQuery returns u without its query string and fragment, which may carry
+// tickets.
+func withoutQuery(u *url.URL) string {
+	stripped := *u
+	stripped.RawQuery = ""
+	stripped.Fragment = ""
+	return stripped.String()
+}
@@ -0,0 +1,87 @@
+package zimbra
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// doRetried is like doThrottled, but also sends a GET request again with an
+// increasing delay after a network error or a 5xx status code, up to
+// config.Retries times.  Other requests, like the login form or the SOAP
+// requests modifying the mailbox, may have been processed before failing, so
+// they are only sent again when the connection failed before they were.
+func doRetried(ctx context.Context, client *http.Client, newReq func() (*http.Request, error)) (*http.Response, error) {
+	var method string
+	build := func() (*http.Request, error) {
+		req, err := newReq()
+		if err == nil {
+			method = req.Method
+		}
+		return req, err
+	}
+
+	delay := config.RetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := doThrottled(ctx, client, build)
+		if attempt >= config.Retries || ctx.Err() != nil {
+			return resp, err
+		}
+		if err != nil && !transient(err) {
+			return nil, err
+		}
+		if method != "GET" && method != "HEAD" && (err == nil || !unsent(err)) {
+			return resp, err
+		}
+		// A SOAP fault is the answer of Zimbra, rather than of a proxy
+		if err == nil && (resp.StatusCode < 500 || strings.HasPrefix(resp.Header.Get("content-type"), "application/json")) {
+			return resp, nil
+		}
+
+		attrs := []any{slog.Duration("delay", delay), slog.Int("attempt", attempt+1)}
+		if err != nil {
+			attrs = append(attrs, slog.Any("error", err))
+		} else {
+			attrs = append(attrs,
+				slog.String("url", withoutQuery(resp.Request.URL)),
+				slog.Int("status", resp.StatusCode))
+			resp.Body.Close()
+		}
+		slog.Warn("Request failed, retrying later", attrs...)
+		err = sleep(ctx, delay)
+		if err != nil {
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// transient reports whether err, returned by client.Do, is a network error
+// which may not happen again, like a dropped connection.
+func transient(err error) bool {
+	if errors.Is(err, ErrThrottled) || errors.Is(err, errUnexpectedHost) {
+		return false
+	}
+
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	return errors.As(err, &opErr) ||
+		errors.As(err, &dnsErr) && dnsErr.IsTemporary ||
+		errors.As(err, &netErr) && netErr.Timeout() ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// unsent reports whether err, returned by client.Do, means that the request
+// wasn't sent at all, because the connection to the server couldn't be made.
+func unsent(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &opErr) && opErr.Op == "dial" || errors.As(err, &dnsErr)
+}
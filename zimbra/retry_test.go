@@ -0,0 +1,52 @@
+package zimbra
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+func TestDoRetriedOnlyGet(t *testing.T) {
+	retries, delay := config.Retries, config.RetryDelay
+	t.Cleanup(func() { config.Retries, config.RetryDelay = retries, delay })
+	config.Retries, config.RetryDelay = 2, time.Millisecond
+
+	var requests int
+	client := newTestClient(t, map[string]http.Handler{
+		"mail.etu.cyu.fr": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(502)
+		}),
+	})
+
+	tests := []struct {
+		method string
+		do     func() (*http.Response, error)
+		want   int
+	}{
+		{"GET", func() (*http.Response, error) {
+			return get(context.Background(), client, "https://mail.etu.cyu.fr/")
+		}, 3},
+		{"POST", func() (*http.Response, error) {
+			return postForm(context.Background(), client, "https://mail.etu.cyu.fr/", url.Values{"lt": {"LT-1"}})
+		}, 1},
+	}
+	for _, test := range tests {
+		requests = 0
+		resp, err := test.do()
+		if err != nil {
+			t.Fatalf("%s: %v", test.method, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 502 {
+			t.Errorf("%s: status code = %v, want 502", test.method, resp.StatusCode)
+		}
+		if requests != test.want {
+			t.Errorf("%s: sent %v times, want %v", test.method, requests, test.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package zimbra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// searchPageSize is the maximum number of results Zimbra returns at once.
+const searchPageSize = 1000
+
+// SearchIDs returns the ids of all e-mails matching query.
+func SearchIDs(ctx context.Context, client *http.Client, query string) ([]string, error) {
+	return searchIDs(ctx, client, query, "", 0, nil)
+}
+
+// searchIDs returns the ids of the e-mails matching query, sorted by sortBy if
+// not empty, except those for which skip returns true, up to limit ids if not
+// 0.
+func searchIDs(ctx context.Context, client *http.Client, query, sortBy string, limit int, skip func(id string) bool) ([]string, error) {
+	url := "https://mail.etu.cyu.fr/service/soap"
+	var ids []string
+
+	slog.Debug("Searching e-mails", slog.String("query", query), slog.String("sort", sortBy))
+	for offset := 0; ; {
+		var body struct {
+			SearchResponse *struct {
+				M []struct {
+					Id string `json:"id"`
+				} `json:"m"`
+				More bool `json:"more"`
+			}
+		}
+		request := map[string]any{
+			"_jsns":  "urn:zimbraMail",
+			"query":  query,
+			"types":  "message",
+			"limit":  searchPageSize,
+			"offset": offset,
+		}
+		if sortBy != "" {
+			request["sortBy"] = sortBy
+		}
+		err := soapRequest(ctx, client, url, nil, map[string]any{
+			"SearchRequest": request,
+		}, &body)
+		if err != nil {
+			return nil, fmt.Errorf("SearchRequest: %w", err)
+		}
+		if body.SearchResponse == nil {
+			return nil, fmt.Errorf("SearchRequest: no search response")
+		}
+
+		for _, m := range body.SearchResponse.M {
+			if skip != nil && skip(m.Id) {
+				continue
+			}
+			ids = append(ids, m.Id)
+			if limit > 0 && len(ids) == limit {
+				break
+			}
+		}
+		offset += len(body.SearchResponse.M)
+		if !body.SearchResponse.More || len(body.SearchResponse.M) == 0 || (limit > 0 && len(ids) == limit) {
+			break
+		}
+	}
+	slog.Debug("Searched e-mails", slog.String("query", query), slog.Int("count", len(ids)))
+
+	return ids, nil
+}
+
+// SelectIDs returns the ids of the config.Limit first e-mails of the folder
+// matching the search query, in config.Order, except those for which skip
+// returns true.
+func SelectIDs(ctx context.Context, client *http.Client, skip func(id string) bool) ([]string, error) {
+	return searchIDs(ctx, client, selectQuery(), SearchOrders[config.Order], config.Limit, skip)
+}
+
+// selectQuery returns the search query matching the e-mails of the folder to
+// fetch.
+func selectQuery() string {
+	query := folderQuery()
+	if q := searchQuery(); q != "" {
+		query += " " + q
+	}
+	return query
+}
+
+// Summary is the sender, subject and date of an e-mail.
+type Summary struct {
+	From    string
+	Subject string
+	Date    time.Time
+}
+
+// Preview returns the summaries of the n newest e-mails which would be
+// fetched, without their bodies.
+func Preview(ctx context.Context, client *http.Client, n int) ([]Summary, error) {
+	url := "https://mail.etu.cyu.fr/service/soap"
+
+	var body struct {
+		SearchResponse *struct {
+			M []struct {
+				Date    int64  `json:"d"`
+				Subject string `json:"su"`
+				E       []struct {
+					Address  string `json:"a"`
+					Personal string `json:"p"`
+					Type     string `json:"t"`
+				} `json:"e"`
+			} `json:"m"`
+		}
+	}
+	err := soapRequest(ctx, client, url, nil, map[string]any{
+		"SearchRequest": map[string]any{
+			"_jsns":  "urn:zimbraMail",
+			"query":  selectQuery(),
+			"types":  "message",
+			"sortBy": "dateDesc",
+			"limit":  n,
+		},
+	}, &body)
+	if err != nil {
+		return nil, fmt.Errorf("SearchRequest: %w", err)
+	}
+	if body.SearchResponse == nil {
+		return nil, fmt.Errorf("SearchRequest: no search response")
+	}
+
+	summaries := make([]Summary, 0, len(body.SearchResponse.M))
+	for _, m := range body.SearchResponse.M {
+		s := Summary{Subject: m.Subject, Date: time.UnixMilli(m.Date)}
+		for _, e := range m.E {
+			if e.Type != "f" {
+				continue
+			}
+			s.From = e.Address
+			if e.Personal != "" {
+				s.From = e.Personal + " <" + e.Address + ">"
+			}
+		}
+		summaries = append(summaries, s)
+	}
+
+	return summaries, nil
+}
+
+// SearchOrders are the Zimbra sort orders of each -order.
+var SearchOrders = map[string]string{
+	"date":      "dateAsc",
+	"date-desc": "dateDesc",
+	// The oldest e-mails are selected, then delivered thread by thread
+	"thread": "dateAsc",
+}
+
+// FolderIDs returns the ids of all e-mails of the folders to export.
+func FolderIDs(ctx context.Context, client *http.Client) ([]string, error) {
+	return SearchIDs(ctx, client, folderQuery())
+}
+
+// folderQuery returns the search query matching the e-mails of the folders to
+// export.
+func folderQuery() string {
+	if config.FolderID != "" {
+		return "inid:" + config.FolderID
+	}
+
+	terms := make([]string, len(config.Folders))
+	for i, folder := range config.Folders {
+		terms[i] = `in:"` + strings.Trim(folder, "/") + `"`
+	}
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	return "(" + strings.Join(terms, " or ") + ")"
+}
+
+// FilterTagged returns the ids which aren't already tagged with config.Tag.
+// Only the tags of ids are searched, config.TagBatchSize at a time, rather
+// than every e-mail of the mailbox tagged by previous runs.
+func FilterTagged(ctx context.Context, client *http.Client, ids []string) ([]string, error) {
+	isTagged := make(map[string]bool)
+	for batch := range slices.Chunk(ids, config.TagBatchSize) {
+		tagged, err := SearchIDs(ctx, client, "tag:"+config.Tag+" item:{"+strings.Join(batch, ",")+"}")
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range tagged {
+			isTagged[id] = true
+		}
+	}
+
+	var untagged []string
+	for _, id := range ids {
+		if !isTagged[id] {
+			untagged = append(untagged, id)
+		}
+	}
+
+	return untagged, nil
+}
@@ -0,0 +1,55 @@
+package zimbra
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+func TestFilterTagged(t *testing.T) {
+	tag, size := config.Tag, config.TagBatchSize
+	t.Cleanup(func() { config.Tag, config.TagBatchSize = tag, size })
+	config.Tag, config.TagBatchSize = "synced", 2
+
+	var queries []string
+	client := newTestClient(t, map[string]http.Handler{
+		"mail.etu.cyu.fr": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Body struct {
+					SearchRequest struct {
+						Query string `json:"query"`
+					}
+				}
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+			queries = append(queries, req.Body.SearchRequest.Query)
+
+			// Only 258 is tagged
+			m := []map[string]string{}
+			if req.Body.SearchRequest.Query == "tag:synced item:{257,258}" {
+				m = append(m, map[string]string{"id": "258"})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"Body": map[string]any{"SearchResponse": map[string]any{"m": m, "more": false}},
+			})
+		}),
+	})
+
+	untagged, err := FilterTagged(context.Background(), client, []string{"257", "258", "259"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"257", "259"}; !slices.Equal(untagged, want) {
+		t.Errorf("untagged = %q, want %q", untagged, want)
+	}
+	if want := []string{"tag:synced item:{257,258}", "tag:synced item:{259}"}; !slices.Equal(queries, want) {
+		t.Errorf("queries = %q, want %q", queries, want)
+	}
+}
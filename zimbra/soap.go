@@ -0,0 +1,108 @@
+package zimbra
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+type soapEnvelope struct {
+	Header any `json:"Header,omitempty"`
+	Body   any `json:"Body"`
+}
+
+// soapFault is the error Zimbra answers a SOAP request with, sometimes with a
+// 200 status code, e.g. when an id doesn't exist.
+type soapFault struct {
+	Reason struct {
+		Text string `json:"Text"`
+	} `json:"Reason"`
+	Detail struct {
+		Error struct {
+			Code string `json:"Code"`
+		} `json:"Error"`
+	} `json:"Detail"`
+}
+
+func (f *soapFault) Error() string {
+	return fmt.Sprintf("SOAP fault %s: %s", f.Detail.Error.Code, f.Reason.Text)
+}
+
+// content is the JSON representation of an XML element's text content.
+type content struct {
+	Content string `json:"_content"`
+}
+
+// soapRequest posts a JSON SOAP request to url, canceled with ctx and bounded
+// by config.Timeout, with an optional header, and decodes the body of the
+// response into resp.
+func soapRequest(ctx context.Context, client *http.Client, url string, header, body, resp any) error {
+	req, err := json.Marshal(soapEnvelope{Header: header, Body: body})
+	if err != nil {
+		return fmt.Errorf("cannot encode SOAP request: %w", err)
+	}
+
+	r, err := doRetried(ctx, bounded(client), func() (*http.Request, error) {
+		r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(req))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Type", "application/soap+xml")
+		return r, nil
+	})
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", url, err)
+	}
+	defer r.Body.Close()
+
+	var raw struct {
+		Body json.RawMessage `json:"Body"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&raw)
+	if err != nil && r.StatusCode != 200 {
+		return fmt.Errorf("POST %s: unexpected status code: %v", url, r.StatusCode)
+	}
+	if err != nil {
+		return fmt.Errorf("POST %s: cannot decode SOAP response: %w", url, err)
+	}
+
+	var fault struct {
+		Fault *soapFault `json:"Fault"`
+	}
+	if json.Unmarshal(raw.Body, &fault) == nil && fault.Fault != nil {
+		return fmt.Errorf("POST %s: %w", url, fault.Fault)
+	}
+	if r.StatusCode != 200 {
+		return fmt.Errorf("POST %s: unexpected status code: %v", url, r.StatusCode)
+	}
+
+	err = json.Unmarshal(raw.Body, resp)
+	if err != nil {
+		return fmt.Errorf("POST %s: cannot decode SOAP response: %w", url, err)
+	}
+	slog.Debug("Got SOAP response", slog.String("url", url))
+
+	return nil
+}
+
+// printSoapRequest prints the JSON SOAP request soapRequest would post to url,
+// with an optional header, instead of posting it.  It is used with
+// -print-requests by the requests modifying the mailbox.
+func printSoapRequest(url string, header, body any) error {
+	req, err := json.Marshal(soapEnvelope{Header: header, Body: body})
+	if err != nil {
+		return fmt.Errorf("cannot encode SOAP request: %w", err)
+	}
+
+	printRequest(url, req)
+	return nil
+}
+
+// printRequest prints the SOAP request body which would be posted to url.
+func printRequest(url string, body []byte) {
+	slog.Info("Not sending request, printing it", slog.String("url", url))
+	fmt.Printf("POST %s\nContent-Type: application/soap+xml\n\n%s\n\n", url, body)
+}
@@ -0,0 +1,75 @@
+package zimbra
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// faultResponse is what Zimbra answers a MsgActionRequest on a message which
+// doesn't exist.
+const faultResponse = `{"Header":{"context":{"change":{"token":1234},"_jsns":"urn:zimbra"}},"Body":{"Fault":{"Code":{"Value":"soap:Sender"},"Reason":{"Text":"no such message: 999"},"Detail":{"Error":{"Code":"mail.NO_SUCH_MSG","Trace":"qtp1-42:1700000000000:abcdef","_jsns":"urn:zimbra"}}}},"_jsns":"urn:zimbraSoap"}`
+
+func TestSoapRequestFault(t *testing.T) {
+	for _, status := range []int{500, 200} {
+		client := newTestClient(t, map[string]http.Handler{
+			"mail.etu.cyu.fr": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(status)
+				w.Write([]byte(faultResponse))
+			}),
+		})
+
+		var resp struct{}
+		err := soapRequest(context.Background(), client, "https://mail.etu.cyu.fr/service/soap", nil, map[string]any{
+			"MsgActionRequest": map[string]any{
+				"_jsns":  "urn:zimbraMail",
+				"action": map[string]any{"op": "tag", "id": "999", "tn": "synced"},
+			},
+		}, &resp)
+
+		var fault *soapFault
+		if !errors.As(err, &fault) {
+			t.Fatalf("status %v: error = %v, want a SOAP fault", status, err)
+		}
+		if fault.Detail.Error.Code != "mail.NO_SUCH_MSG" {
+			t.Errorf("status %v: code = %q, want %q", status, fault.Detail.Error.Code, "mail.NO_SUCH_MSG")
+		}
+		if fault.Reason.Text != "no such message: 999" {
+			t.Errorf("status %v: reason = %q, want %q", status, fault.Reason.Text, "no such message: 999")
+		}
+	}
+}
+
+func TestSoapRequestStalledBody(t *testing.T) {
+	timeout, retries := config.Timeout, config.Retries
+	t.Cleanup(func() { config.Timeout, config.Retries = timeout, retries })
+	config.Timeout, config.Retries = 50*time.Millisecond, 0
+
+	client := newTestClient(t, map[string]http.Handler{
+		"mail.etu.cyu.fr": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(200)
+			w.Write([]byte(`{"Body":{`))
+			w.(http.Flusher).Flush()
+			// The rest of the body never comes
+			<-r.Context().Done()
+		}),
+	})
+
+	started := time.Now()
+	var resp struct{}
+	err := soapRequest(context.Background(), client, "https://mail.etu.cyu.fr/service/soap", nil, map[string]any{
+		"GetInfoRequest": map[string]any{"_jsns": "urn:zimbraAccount"},
+	}, &resp)
+	if err == nil {
+		t.Fatal("no error on a stalled body")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("gave up after %v, want about %v", elapsed, config.Timeout)
+	}
+}
@@ -0,0 +1,83 @@
+package zimbra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+type Tag struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Number of items with this tag
+	Count int `json:"n"`
+}
+
+// Tags returns all the tags of the mailbox.
+func Tags(ctx context.Context, client *http.Client) ([]Tag, error) {
+	url := "https://mail.etu.cyu.fr/service/soap"
+
+	var body struct {
+		GetTagResponse *struct {
+			Tag []Tag `json:"tag"`
+		}
+	}
+	err := soapRequest(ctx, client, url, nil, map[string]any{
+		"GetTagRequest": map[string]any{
+			"_jsns": "urn:zimbraMail",
+		},
+	}, &body)
+	if err != nil {
+		return nil, fmt.Errorf("GetTagRequest: %w", err)
+	}
+	if body.GetTagResponse == nil {
+		return nil, fmt.Errorf("GetTagRequest: no tag response")
+	}
+
+	return body.GetTagResponse.Tag, nil
+}
+
+// CreateTag creates the tag named name, unless it already exists.
+func CreateTag(ctx context.Context, client *http.Client, name string) error {
+	url := "https://mail.etu.cyu.fr/service/soap"
+
+	tags, err := Tags(ctx, client)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if tag.Name == name {
+			return nil
+		}
+	}
+
+	request := map[string]any{
+		"CreateTagRequest": map[string]any{
+			"_jsns": "urn:zimbraMail",
+			"tag": map[string]any{
+				"name": name,
+			},
+		},
+	}
+	if config.PrintRequests {
+		return printSoapRequest(url, nil, request)
+	}
+
+	slog.Info("Creating tag", slog.String("url", url), slog.String("tag", name))
+	var body struct {
+		CreateTagResponse *struct{}
+	}
+	err = soapRequest(ctx, client, url, nil, request, &body)
+	if err != nil {
+		return fmt.Errorf("CreateTagRequest: %w", err)
+	}
+	if body.CreateTagResponse == nil {
+		return fmt.Errorf("CreateTagRequest: no tag response")
+	}
+	slog.Debug("Created tag", slog.String("tag", name))
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package zimbra
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+var ErrThrottled = errors.New("throttled by Zimbra")
+
+// throttleSignatures are found in the error pages Zimbra serves, sometimes with
+// a 200 status code, when it receives too many requests.
+var throttleSignatures = []string{
+	"too many requests",
+	"service unavailable",
+	"dosfilter",
+}
+
+// doThrottled sends the request built by newReq, and sends it again with an
+// increasing delay as long as Zimbra throttles it, up to
+// config.ThrottleRetries times.
+func doThrottled(ctx context.Context, client *http.Client, newReq func() (*http.Request, error)) (*http.Response, error) {
+	delay := config.ThrottleDelay
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if !throttled(resp) {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if attempt >= config.ThrottleRetries {
+			return nil, fmt.Errorf("%w, after %v attempts", ErrThrottled, attempt+1)
+		}
+		slog.Warn("Throttled by Zimbra, retrying later",
+			slog.String("url", req.URL.String()),
+			slog.Duration("delay", delay))
+		err = sleep(ctx, delay)
+		if err != nil {
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// throttled reports whether resp is an error page served by Zimbra because of
+// too many requests.  The body of resp stays readable.
+func throttled(resp *http.Response) bool {
+	if resp.StatusCode == 429 || resp.StatusCode == 503 {
+		return true
+	}
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("content-type"), "text/html") {
+		return false
+	}
+
+	// Error pages are short, so their signature is at the beginning
+	prefix, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), resp.Body), resp.Body}
+	if err != nil {
+		return false
+	}
+
+	page := strings.ToLower(string(prefix))
+	for _, signature := range throttleSignatures {
+		if strings.Contains(page, signature) {
+			return true
+		}
+	}
+
+	return false
+}
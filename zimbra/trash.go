@@ -0,0 +1,46 @@
+package zimbra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// trashFolderId is the id of the Trash folder in every Zimbra mailbox.
+const trashFolderId = "3"
+
+// EmptyTrash permanently deletes everything in the Trash folder.
+func EmptyTrash(ctx context.Context, client *http.Client) error {
+	url := "https://mail.etu.cyu.fr/service/soap"
+
+	request := map[string]any{
+		"FolderActionRequest": map[string]any{
+			"_jsns": "urn:zimbraMail",
+			"action": map[string]any{
+				"op": "empty",
+				"id": trashFolderId,
+			},
+		},
+	}
+	if config.PrintRequests {
+		return printSoapRequest(url, nil, request)
+	}
+
+	slog.Info("Emptying trash", slog.String("url", url))
+	var body struct {
+		FolderActionResponse *struct{}
+	}
+	err := soapRequest(ctx, client, url, nil, request, &body)
+	if err != nil {
+		return fmt.Errorf("FolderActionRequest: %w", err)
+	}
+	if body.FolderActionResponse == nil {
+		return fmt.Errorf("FolderActionRequest: no folder action response")
+	}
+	slog.Debug("Emptied trash")
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package zimbra
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// watchdogBody cancels the request it is the body of if a read blocks for
+// longer than timeout, so that a stalled download doesn't hang forever.  A zero
+// timeout disables the watchdog.  The request is canceled once the body is
+// closed anyway, to release its context.
+type watchdogBody struct {
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	stalled atomic.Bool
+}
+
+func (b *watchdogBody) Read(p []byte) (int, error) {
+	if b.timeout == 0 {
+		return b.body.Read(p)
+	}
+
+	timer := time.AfterFunc(b.timeout, func() {
+		b.stalled.Store(true)
+		b.cancel()
+	})
+	n, err := b.body.Read(p)
+	timer.Stop()
+
+	if err != nil && b.stalled.Load() {
+		err = fmt.Errorf("download stalled, no data received for %v", b.timeout)
+	}
+	return n, err
+}
+
+func (b *watchdogBody) Close() error {
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
@@ -1,14 +1,22 @@
 package zimbra
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"slices"
 	"strings"
 
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/html"
 	"golang.org/x/net/publicsuffix"
 	"ransan.fr/zimbridge/mda/config"
@@ -20,16 +28,80 @@ func Initialize() (*http.Client, error) {
 		return nil, fmt.Errorf("cookiejar.New: %w", err)
 	}
 
+	if config.AuthCookieFile != "" {
+		token, err := readAuthCookieFile(config.AuthCookieFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read auth cookie: %w", err)
+		}
+		setAuthToken(jar, token)
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.MaxIdleConnsPerHost = config.MaxIdleConns
+	base.IdleConnTimeout = config.IdleConnTimeout
+	// Rather than a timeout of the client, which would also bound the time
+	// to download the archive: the other requests are bounded whole instead
+	base.ResponseHeaderTimeout = config.Timeout
+	base.TLSClientConfig = &tls.Config{VerifyConnection: checkCertExpiry}
+
+	var transport http.RoundTripper = &traceTransport{next: base}
+	if len(config.Headers) > 0 {
+		transport = &headerTransport{
+			next:   transport,
+			header: config.Headers,
+		}
+	}
+	if config.MaxConns > 0 {
+		transport = &limitedTransport{
+			next: transport,
+			sem:  make(chan struct{}, config.MaxConns),
+		}
+	}
+
+	if config.OTelEndpoint != "" {
+		transport = otelhttp.NewTransport(transport)
+	}
+
 	client := &http.Client{
-		Jar: jar,
+		Jar:           &authJar{CookieJar: jar},
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
 	}
 
 	return client, nil
 }
 
-func Login(client *http.Client) error {
+// ErrLoginLoop is returned by Login when it fails to reach the webmail, with
+// the pages visited on the way.
+type ErrLoginLoop struct {
+	// URLs of the pages, including redirects, without their query strings
+	Visited []string
+	Err     error
+}
+
+func (e *ErrLoginLoop) Error() string {
+	return fmt.Sprintf("login failed after visiting %s: %v", strings.Join(e.Visited, " -> "), e.Err)
+}
+
+func (e *ErrLoginLoop) Unwrap() error {
+	return e.Err
+}
+
+func Login(ctx context.Context, client *http.Client) (err error) {
+	ctx, span := tracer.Start(ctx, "Login")
+	step := 0
+	var visited []string
+	defer func() {
+		slog.Debug("Visited login pages", slog.Any("visited", visited))
+		if err != nil && len(visited) > 0 {
+			err = &ErrLoginLoop{Visited: visited, Err: err}
+		}
+		span.SetAttributes(attribute.Int("login.steps", step))
+		endSpan(span, err)
+	}()
+
 	slog.Info("Requesting login form")
-	resp, err := client.Get("https://mail.etu.cyu.fr/")
+	resp, err := get(ctx, client, "https://mail.etu.cyu.fr/")
 	if err != nil {
 		return fmt.Errorf("GET https://mail.etu.cyu.fr/: %w", err)
 	}
@@ -39,21 +111,48 @@ func Login(client *http.Client) error {
 	if ct := resp.Header.Get("content-type"); !strings.HasPrefix(ct, "text/html") {
 		return fmt.Errorf("GET https://mail.etu.cyu.fr/: unexpected content-type: %s", ct)
 	}
+	visited = appendVisited(visited, resp)
 	slog.Debug("Got login form", slog.Any("url", resp.Request.URL))
 
+	err = dumpLoginPage(step, resp)
+	if err != nil {
+		return err
+	}
+
 	// It seems to take a random amound of steps to log in
-	// TODO: check for <form><div id="status" class="errors"> in output from
-    //       https://auth.u-cergy.fr/login, indicating wrong login info
 	for resp.Request.URL.Host != "mail.etu.cyu.fr" {
+		if config.MaxLoginSteps > 0 && step >= config.MaxLoginSteps {
+			return fmt.Errorf("still not logged in after %v steps, last at %s on host %s",
+				step, withoutQuery(resp.Request.URL), resp.Request.URL.Host)
+		}
+
+		doc, err := html.Parse(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot parse login page: %w", err)
+		}
+
+		// The CAS shows the login form again on wrong credentials
+		err = loginError(doc)
+		if err != nil {
+			return err
+		}
+
 		slog.Debug("Extracting form informations")
-		url, inputs, err := extractFormInfo(resp)
+		url, inputs, err := extractFormInfo(resp.Request.URL, doc)
 		if err != nil {
 			return fmt.Errorf("cannot extract form informations: %w", err)
 		}
 		slog.Debug("Extracted form informations")
 
+		step++
+		err = dumpLoginRequest(step, url, inputs)
+		if err != nil {
+			return err
+		}
+
 		slog.Info("Doing one login step", slog.String("url", url))
-		resp, err = client.PostForm(url, inputs)
+		resp, err = postForm(ctx, client, url, inputs)
 		if err != nil {
 			return fmt.Errorf("POST %s: %w", url, err)
 		}
@@ -63,41 +162,331 @@ func Login(client *http.Client) error {
 		if ct := resp.Header.Get("content-type"); !strings.HasPrefix(ct, "text/html") {
 			return fmt.Errorf("POST %s: unexpected content-type: %s", url, ct)
 		}
+		visited = appendVisited(visited, resp)
 		slog.Debug("Did one login step", slog.Any("url", resp.Request.URL))
+
+		err = dumpLoginPage(step, resp)
+		if err != nil {
+			return err
+		}
+
+		resp, err = awaitApproval(ctx, client, resp)
+		if err != nil {
+			return err
+		}
+		visited = appendVisited(visited, resp)
+	}
+	// Read to the end, so that the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if !hasAuthToken(client.Jar) {
+		return fmt.Errorf("reached the webmail without getting a %s cookie", authCookie)
 	}
 
 	return nil
 }
 
-func FetchArchive(client *http.Client) (io.ReadCloser, error) {
+// bounded returns a copy of client whose requests time out after
+// config.Timeout, including reading their body, so that a connection stalled
+// after the headers doesn't block forever.  The archive is downloaded with
+// client itself, bounded by -fetch-timeout and -stall-timeout instead.
+func bounded(client *http.Client) *http.Client {
+	c := *client
+	c.Timeout = config.Timeout
+	return &c
+}
+
+// get is like client.Get, canceled with ctx, bounded by config.Timeout, and
+// retried with doRetried.
+func get(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	return doRetried(ctx, bounded(client), func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	})
+}
+
+// postForm is like client.PostForm, canceled with ctx, bounded by
+// config.Timeout, and retried with doRetried.
+func postForm(ctx context.Context, client *http.Client, url string, data url.Values) (*http.Response, error) {
+	return doRetried(ctx, bounded(client), func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+}
+
+// appendVisited appends the URL of resp to visited, after those it was
+// redirected from, unless it is already the last one.  Query strings are
+// dropped, since they may carry tickets.
+func appendVisited(visited []string, resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil; {
+		chain = append(chain, withoutQuery(req.URL))
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if len(visited) == 0 || visited[len(visited)-1] != chain[i] {
+			visited = append(visited, chain[i])
+		}
+	}
+	return visited
+}
+
+// ArchiveURL returns the REST URL from which the tarball of e-mails is fetched.
+func ArchiveURL() string {
 	var query string
-	if config.Tag != "" {
-		query = "&query=not%20tag:" + config.Tag
+	if config.Types != "" {
+		query += "&types=" + url.QueryEscape(config.Types)
 	}
-	url := "https://mail.etu.cyu.fr/home/" + config.Address + "/inbox?fmt=tgz&meta=1" + query
+	if q := archiveQuery(); q != "" {
+		query += "&query=" + url.QueryEscape(q)
+	}
+	return "https://mail.etu.cyu.fr/home/" + config.Address + "/" + folderPath() + "fmt=" + config.ArchiveFormat + "&meta=1" + query
+}
+
+// listURL returns the REST URL from which the tarball of e-mails ids is
+// fetched, wherever they are in the mailbox.
+func listURL(ids []string) string {
+	return "https://mail.etu.cyu.fr/home/" + config.Address + "/?fmt=" + config.ArchiveFormat + "&meta=1&list=" + strings.Join(ids, ",")
+}
+
+// folderPath returns the path of the folder to export in the REST URL, up to
+// its query string.  Ids don't depend on the language of the folder names.
+// Several folders are exported from the root of the mailbox, and selected by
+// archiveQuery.
+func folderPath() string {
+	if config.FolderID != "" {
+		return "?id=" + url.QueryEscape(config.FolderID) + "&"
+	}
+	if len(config.Folders) > 1 {
+		return "?"
+	}
+
+	parts := strings.Split(strings.Trim(config.Folders[0], "/"), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/") + "?"
+}
 
-	slog.Info("Requesting tarball", slog.String("url", url))
-	resp, err := client.Get(url)
+// FetchArchive requests the tarball of e-mails matching the search query, or
+// of the e-mails ids regardless of the query if not nil, along with its size as
+// sent, i.e. compressed, or -1 if it isn't known.  It returns a nil reader if
+// there is no such e-mail.
+func FetchArchive(ctx context.Context, client *http.Client, ids []string) (_ io.ReadCloser, _ int64, err error) {
+	url := ArchiveURL()
+	if ids != nil {
+		url = listURL(ids)
+	}
+
+	ctx, span := tracer.Start(ctx, "FetchArchive")
+	defer func() { endSpan(span, err) }()
+
+	// The fallback on the folder id isn't canceled along with this request
+	parent := ctx
+	var cancel context.CancelFunc
+	if config.FetchTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, config.FetchTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	slog.Info("Requesting tarball", slog.String("url", url), slog.String("query", archiveQuery()))
+	resp, err := doRetried(ctx, client, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if config.ArchiveFormat == "tar" {
+			// Setting it disables the transparent decompression of the
+			// transport, so that the Content-Encoding can be checked
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		return req, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("GET %s: %w", url, err)
+		cancel()
+		return nil, 0, fmt.Errorf("GET %s: %w", url, err)
+	}
+	if resp.StatusCode == 204 {
+		// Zimbra answers with No Content when the query matches no e-mail
+		resp.Body.Close()
+		cancel()
+		slog.Debug("Got no tarball", slog.Any("url", resp.Request.URL))
+		return nil, 0, nil
+	}
+	if resp.StatusCode == 404 && config.FolderID == "" && len(config.Folders) == 1 && ids == nil {
+		// The REST path of a folder may differ from its name on some servers
+		resp.Body.Close()
+		cancel()
+		id, err := FolderID(parent, client, config.Folders[0])
+		if err != nil {
+			return nil, 0, fmt.Errorf("GET %s: folder not found: %w", url, err)
+		}
+		slog.Info("Requesting folder by id", slog.String("folder", config.Folders[0]), slog.String("id", id))
+		config.FolderID = id
+		return FetchArchive(parent, client, ids)
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("GET %s: unexpected status code: %v", url, resp.StatusCode)
+		resp.Body.Close()
+		cancel()
+		return nil, 0, fmt.Errorf("GET %s: unexpected status code: %v", url, resp.StatusCode)
+	}
+
+	body := &watchdogBody{
+		body:    resp.Body,
+		cancel:  cancel,
+		timeout: config.StallTimeout,
+	}
+
+	// Zimbra sometimes answers with an empty body instead of No Content
+	br := bufio.NewReader(body)
+	_, err = br.Peek(1)
+	if resp.ContentLength == 0 || err == io.EOF {
+		body.Close()
+		slog.Debug("Got empty tarball", slog.Any("url", resp.Request.URL))
+		return nil, 0, nil
+	}
+	if err != nil {
+		body.Close()
+		return nil, 0, fmt.Errorf("GET %s: %w", url, err)
+	}
+
+	// The archive is read in the format the server actually sent, so that a
+	// plain tarball isn't given to gzip, nor the other way around
+	ct := resp.Header.Get("content-type")
+	format := archiveFormat(ct)
+	if format == "" {
+		body.Close()
+		return nil, 0, fmt.Errorf("GET %s: unexpected content-type: %s", url, ct)
 	}
-	if ct := resp.Header.Get("content-type"); !strings.HasPrefix(ct, "application/x-compressed-tar") {
-		return nil, fmt.Errorf("GET %s: unexpected content-type: %s", url, ct)
+	if format != config.ArchiveFormat {
+		slog.Warn("Got another archive format than requested",
+			slog.String("requested", config.ArchiveFormat),
+			slog.String("format", format))
+		config.ArchiveFormat = format
+	}
+	span.SetAttributes(
+		attribute.Int64("archive.content_length", resp.ContentLength),
+		attribute.String("archive.content_encoding", resp.Header.Get("content-encoding")))
+	slog.Debug("Got tarball",
+		slog.Any("url", resp.Request.URL),
+		slog.String("content-encoding", resp.Header.Get("content-encoding")))
+
+	var r io.Reader = br
+	if resp.Header.Get("content-encoding") == "gzip" {
+		r, err = gzip.NewReader(br)
+		if err != nil {
+			body.Close()
+			return nil, 0, fmt.Errorf("GET %s: invalid gzip stream: %w", url, err)
+		}
 	}
-	slog.Debug("Got tarball", slog.Any("url", resp.Request.URL))
 
-	return resp.Body, nil
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, body}, resp.ContentLength, nil
 }
 
-func extractFormInfo(resp *http.Response) (actionUrl string, inputs url.Values, err error) {
-	doc, err := html.Parse(resp.Body)
-	if err != nil {
-		return
+// archiveContentTypes are the content types of the archive in each format.
+var archiveContentTypes = map[string]string{
+	"tgz": "application/x-compressed-tar",
+	"tar": "application/x-tar",
+}
+
+// archiveFormat returns the format of the archive with the content type ct,
+// or an empty string if it isn't an archive.
+func archiveFormat(ct string) string {
+	for format, prefix := range archiveContentTypes {
+		if strings.HasPrefix(ct, prefix) {
+			return format
+		}
+	}
+	return ""
+}
+
+// searchQuery assembles the Zimbra search query selecting which e-mails are
+// exported, or returns an empty string if every e-mail should be.
+func searchQuery() string {
+	var terms []string
+	if config.TagScope != "" {
+		terms = append(terms, `not (tag:`+config.Tag+` in:"`+strings.Trim(config.TagScope, "/")+`")`)
+	} else if config.Tag != "" {
+		terms = append(terms, "not tag:"+config.Tag)
+	}
+	if config.OnlyUnread {
+		terms = append(terms, "is:unread")
+	}
+	return strings.Join(terms, " ")
+}
+
+// archiveQuery returns the search query of the REST URL, which also selects
+// the folders when there are several of them.
+func archiveQuery() string {
+	if config.FolderID != "" || len(config.Folders) == 1 {
+		return searchQuery()
+	}
+	return strings.TrimSpace(folderQuery() + " " + searchQuery())
+}
+
+// ErrBadCredentials is returned by Login when the CAS refuses the username or
+// the password.
+var ErrBadCredentials = errors.New("wrong username or password")
+
+// loginError returns ErrBadCredentials, along with the message of the CAS, if
+// n has a <div id="status" class="errors">, as the CAS login form has after
+// a failed attempt.
+func loginError(n *html.Node) error {
+	if n.Type == html.ElementNode && n.Data == "div" {
+		var id, class string
+		for _, a := range n.Attr {
+			switch a.Key {
+			case "id":
+				id = a.Val
+			case "class":
+				class = a.Val
+			}
+		}
+
+		if id == "status" && slices.Contains(strings.Fields(class), "errors") {
+			message := strings.Join(strings.Fields(textContent(n)), " ")
+			if message == "" {
+				return ErrBadCredentials
+			}
+			return fmt.Errorf("%w: %s", ErrBadCredentials, message)
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if err := loginError(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// textContent returns the text of n and of its descendants.
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+
+	var text string
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		text += textContent(c)
 	}
+	return text
+}
 
+func extractFormInfo(base *url.URL, doc *html.Node) (actionUrl string, inputs url.Values, err error) {
 	action, inputs, err := formInfo(doc)
 	if err != nil {
 		return
@@ -108,7 +497,14 @@ func extractFormInfo(resp *http.Response) (actionUrl string, inputs url.Values,
 		return
 	}
 
-	actionUrl = resp.Request.URL.ResolveReference(parsedAction).String()
+	resolved := base.ResolveReference(parsedAction)
+	// Before anything, like credentials, is posted to it
+	if !hostAllowed(resolved) {
+		err = fmt.Errorf("form posted to %w %s, which -allow-host may allow", errUnexpectedHost, resolved.Hostname())
+		return
+	}
+
+	actionUrl = resolved.String()
 	return
 }
 
@@ -166,12 +562,16 @@ func formInputs(n *html.Node, inputs url.Values) error {
 
 		switch typ {
 		case "submit":
-			fallthrough
-		case "hidden":
 			if name != "" && value != "" {
 				inputs.Add(name, value)
 				goto added
 			}
+		case "hidden":
+			// CAS requires some hidden fields to be present, even when empty
+			if name != "" {
+				inputs.Add(name, value)
+				goto added
+			}
 		case "text":
 			if name == "username" {
 				inputs.Add("username", config.Username)
@@ -202,31 +602,69 @@ func formInputs(n *html.Node, inputs url.Values) error {
 	return nil
 }
 
-func TagMails(client *http.Client, ids []string) error {
-	url := "https://mail.etu.cyu.fr/service/soap"
-
-	body := fmt.Sprintf(`{
-  "Body": {
-    "MsgActionRequest": {
-      "_jsns": "urn:zimbraMail",
-      "action": {
-        "op": "tag",
-        "tn": "%s",
-        "id": "%s"
-      }
-    }
-  }
-}`, config.Tag, strings.Join(ids, ","))
-
-	slog.Info("Deleting e-mails", slog.String("url", url), slog.Any("ids", ids))
-	resp, err := client.Post(url, "application/soap+xml", strings.NewReader(body))
+// TagMails tags the e-mails ids with tag, and returns those which were tagged,
+// even on error.
+func TagMails(ctx context.Context, client *http.Client, tag string, ids []string) ([]string, error) {
+	slog.Info("Tagging e-mails", slog.String("tag", tag), slog.Any("ids", ids))
+	tagged, err := msgAction(ctx, client, "tag", ids, map[string]any{"tn": tag})
 	if err != nil {
-		return fmt.Errorf("POST %s: %w", url, err)
+		return tagged, err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("POST %s: unexpected status code: %v", url, resp.StatusCode)
+	slog.Debug("Tagged e-mails", slog.String("tag", tag))
+
+	return tagged, nil
+}
+
+// msgAction applies the operation op to the e-mails ids, with the other
+// attributes of the action in attrs, e.g. the tag name, config.TagBatchSize
+// e-mails at a time.  The next batches are still sent after a failed one, and
+// it returns the ids of the successful batches along with the errors.  With
+// -print-requests, it prints the requests instead.
+func msgAction(ctx context.Context, client *http.Client, op string, ids []string, attrs map[string]any) ([]string, error) {
+	url := "https://mail.etu.cyu.fr/service/soap"
+
+	var done []string
+	var errs []error
+	for batch := range slices.Chunk(ids, config.TagBatchSize) {
+		action := map[string]any{
+			"op": op,
+			"id": strings.Join(batch, ","),
+		}
+		for name, value := range attrs {
+			action[name] = value
+		}
+		request := map[string]any{
+			"MsgActionRequest": map[string]any{
+				"_jsns":  "urn:zimbraMail",
+				"action": action,
+			},
+		}
+		if config.PrintRequests {
+			err := printSoapRequest(url, nil, request)
+			if err != nil {
+				return done, err
+			}
+			done = append(done, batch...)
+			continue
+		}
+
+		slog.Debug("Sending message action",
+			slog.String("url", url),
+			slog.String("op", op),
+			slog.Int("count", len(batch)))
+		var body struct {
+			MsgActionResponse *struct{}
+		}
+		err := soapRequest(ctx, client, url, nil, request, &body)
+		if err == nil && body.MsgActionResponse == nil {
+			err = fmt.Errorf("no message action response")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MsgActionRequest %s of %v e-mails: %w", op, len(batch), err))
+			continue
+		}
+		done = append(done, batch...)
 	}
-	slog.Debug("Deleted e-mails")
 
-	return nil
+	return done, errors.Join(errs...)
 }
@@ -0,0 +1,166 @@
+package zimbra
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"ransan.fr/zimbridge/mda/config"
+)
+
+// hostRouter sends the requests for each host to its test server, so that
+// clients can be tested with the real URLs of the webmail.
+type hostRouter map[string]*httptest.Server
+
+func (r hostRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	srv, ok := r[req.URL.Host]
+	if !ok {
+		return nil, errUnexpectedHost
+	}
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	return srv.Client().Transport.RoundTrip(req)
+}
+
+// newTestClient returns a client like Initialize does, whose requests for
+// each host go to its handler.
+func newTestClient(t *testing.T, handlers map[string]http.Handler) *http.Client {
+	t.Helper()
+
+	router := hostRouter{}
+	for host, handler := range handlers {
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+		router[host] = srv
+	}
+
+	client, err := Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Transport = router
+	return client
+}
+
+func TestFormInputsEmptyHidden(t *testing.T) {
+	username, password := config.Username, config.Password
+	t.Cleanup(func() { config.Username, config.Password = username, password })
+	config.Username, config.Password = "user", "secret"
+
+	doc, err := html.Parse(strings.NewReader(`<form method="post">
+<input type="text" name="username">
+<input type="password" name="password">
+<input type="hidden" name="lt" value="LT-1">
+<input type="hidden" name="execution" value="e1s1">
+<input type="hidden" name="_eventId" value="submit">
+<input type="hidden" name="geolocation" value="">
+<input type="hidden" name="ignored">
+<input type="submit" value="Log in">
+</form>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := url.Values{}
+	if err := formInputs(doc, inputs); err != nil {
+		t.Fatal(err)
+	}
+
+	want := url.Values{
+		"username":    {"user"},
+		"password":    {"secret"},
+		"lt":          {"LT-1"},
+		"execution":   {"e1s1"},
+		"_eventId":    {"submit"},
+		"geolocation": {""},
+		"ignored":     {""},
+	}
+	if got, want := inputs.Encode(), want.Encode(); got != want {
+		t.Errorf("inputs = %s, want %s", got, want)
+	}
+	for _, key := range []string{"geolocation", "ignored"} {
+		if !inputs.Has(key) {
+			t.Errorf("empty hidden input %q missing", key)
+		}
+	}
+}
+
+func TestFetchArchiveEmpty(t *testing.T) {
+	address, folders, format := config.Address, config.Folders, config.ArchiveFormat
+	t.Cleanup(func() { config.Address, config.Folders, config.ArchiveFormat = address, folders, format })
+	config.Address, config.Folders, config.ArchiveFormat = "user@etu.cyu.fr", []string{"Inbox"}, "tgz"
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "Content-Length: 0",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/x-compressed-tar")
+				w.Header().Set("Content-Length", "0")
+				w.WriteHeader(200)
+			},
+		},
+		{
+			name: "chunked",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/x-compressed-tar")
+				w.WriteHeader(200)
+				// Sends the headers without a length, so that the body is
+				// chunked
+				w.(http.Flusher).Flush()
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(t, map[string]http.Handler{
+				"mail.etu.cyu.fr": test.handler,
+			})
+			archive, _, err := FetchArchive(context.Background(), client, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if archive != nil {
+				archive.Close()
+				t.Error("got an archive, want nil")
+			}
+		})
+	}
+}
+
+func TestArchiveQuery(t *testing.T) {
+	folders, folderID, tag, scope, unread := config.Folders, config.FolderID, config.Tag, config.TagScope, config.OnlyUnread
+	t.Cleanup(func() {
+		config.Folders, config.FolderID, config.Tag, config.TagScope, config.OnlyUnread = folders, folderID, tag, scope, unread
+	})
+	config.FolderID, config.OnlyUnread = "", false
+
+	tests := []struct {
+		folders    []string
+		tag, scope string
+		want       string
+	}{
+		{[]string{"Inbox"}, "", "", ""},
+		{[]string{"Inbox"}, "synced", "", "not tag:synced"},
+		{[]string{"Inbox"}, "synced", "Inbox", `not (tag:synced in:"Inbox")`},
+		{[]string{"Inbox", "Sent"}, "synced", "", `(in:"Inbox" or in:"Sent") not tag:synced`},
+		{[]string{"Inbox", "Sent"}, "synced", "/Inbox/", `(in:"Inbox" or in:"Sent") not (tag:synced in:"Inbox")`},
+	}
+	for _, test := range tests {
+		config.Folders, config.Tag, config.TagScope = test.folders, test.tag, test.scope
+		if got := archiveQuery(); got != test.want {
+			t.Errorf("archiveQuery() with -folder %q -tag %q -tag-scope %q = %q, want %q", test.folders, test.tag, test.scope, got, test.want)
+		}
+	}
+}